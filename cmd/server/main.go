@@ -2,10 +2,14 @@
 package main
 
 import (
+	"context"
+	"diploma-back/internal/artifacts"
 	"diploma-back/internal/database"
 	"diploma-back/internal/handlers"
 	"diploma-back/internal/middleware"
+	"diploma-back/internal/registry"
 	"diploma-back/internal/storage"
+	"diploma-back/pkg/imaging"
 	"log"
 	"os"
 
@@ -30,10 +34,35 @@ func main() {
 		log.Fatal("Failed to migrate database:", err)
 	}
 
-	minioClient, err := storage.NewMinIOClient()
+	if err := database.GrantAdmins(db); err != nil {
+		log.Fatal("Failed to grant admin rights:", err)
+	}
+
+	objectStore, err := storage.NewObjectStore()
+	if err != nil {
+		log.Fatal("Failed to initialize object store:", err)
+	}
+	var store storage.ObjectStore = artifacts.NewAccountedStore(db, objectStore)
+
+	// Downloads go through the API when browsers cannot reach the store
+	proxyDownloads, err := storage.ProxyDownloads(objectStore)
 	if err != nil {
-		log.Fatal("Failed to initialize MinIO client:", err)
+		log.Fatal("Failed to initialize object store:", err)
 	}
+	if proxyDownloads {
+		store = storage.NewProxyStore(store)
+	}
+
+	inferenceBackend, err := imaging.NewInferenceBackend()
+	if err != nil {
+		log.Fatal("Failed to initialize inference backend:", err)
+	}
+
+	modelRegistry := registry.New(db, inferenceBackend)
+	modelRegistry.StartHealthChecks(context.Background())
+
+	janitor := artifacts.NewJanitor(db, store)
+	janitor.Start(context.Background())
 
 	// Initialize Gin router
 	r := gin.Default()
@@ -47,6 +76,19 @@ func main() {
 		public.POST("/register", handlers.Register(db))
 		public.POST("/login", handlers.Login(db))
 		public.POST("/logout", handlers.Logout)
+		public.GET("/health", handlers.Health(modelRegistry, false))
+	}
+
+	// Files of the local object store, authenticated by URL signature
+	if localStore, ok := objectStore.(*storage.LocalStore); ok {
+		r.GET("/api/files/*key", handlers.ServeLocalFile(localStore))
+		r.PUT("/api/files/*key", handlers.ReceiveLocalFile(localStore))
+	}
+
+	// Internal routes, authenticated by request signature
+	internal := r.Group("/api/internal")
+	{
+		internal.POST("/jobs/:id/result", handlers.JobResultCallback(db, store))
 	}
 
 	// Protected routes
@@ -54,11 +96,39 @@ func main() {
 	protected.Use(middleware.AuthMiddleware())
 	{
 		protected.GET("/profile", handlers.GetProfile(db))
-		protected.POST("/upload", handlers.UploadImage(db, minioClient))
+		protected.POST("/upload", handlers.UploadImage(db, store, modelRegistry))
+		protected.POST("/uploads", handlers.CreateUpload(db, store))
+		protected.POST("/uploads/:id/complete", handlers.CompleteUpload(db, store, modelRegistry))
+		protected.POST("/uploads/resumable", handlers.CreateResumableUpload(db))
+		protected.HEAD("/uploads/resumable/:id", handlers.GetResumableUpload(db))
+		protected.PATCH("/uploads/resumable/:id", handlers.PatchResumableUpload(db, store))
 		// protected.POST("/process", handlers.ProcessImage(db))
-		protected.GET("/results/:id", handlers.GetResult(db, minioClient))
-		protected.GET("/results/:id/download", handlers.DownloadResult(db, minioClient))
-		protected.GET("/history", handlers.GetHistory(db, minioClient))
+		protected.GET("/results/:id", handlers.GetResult(db, store))
+		protected.GET("/results/:id/download", handlers.DownloadResult(db, store))
+		protected.GET("/history", handlers.GetHistory(db, store))
+		protected.GET("/compare", handlers.CompareResults(db, store))
+		protected.GET("/models", handlers.ListModels(db))
+		protected.GET("/usage", handlers.GetUsage(db))
+		if proxyDownloads {
+			protected.GET("/objects/*key", handlers.ServeObject(store))
+		}
+	}
+
+	// Admin routes
+	admin := r.Group("/api/admin")
+	admin.Use(middleware.AuthMiddleware(), middleware.AdminMiddleware(db))
+	{
+		admin.GET("/models", handlers.AdminListModels(db))
+		admin.POST("/models", handlers.CreateModel(db))
+		admin.PUT("/models/:id", handlers.UpdateModel(db, modelRegistry))
+		admin.DELETE("/models/:id", handlers.DeleteModel(db, modelRegistry))
+		admin.GET("/health", handlers.Health(modelRegistry, true))
+		admin.GET("/retention", handlers.RetentionReport(janitor))
+		admin.POST("/retention/run", handlers.RunRetention(janitor))
+		admin.PUT("/users/:id/quota", handlers.SetUserQuota(db))
+		if minioStore, ok := objectStore.(*storage.MinIOClient); ok {
+			admin.POST("/storage/rotate-keys", handlers.RotateStorageKeys(minioStore))
+		}
 	}
 
 	// Get port from env or use default
@@ -0,0 +1,103 @@
+package artifacts
+
+import (
+	"context"
+	"diploma-back/internal/models"
+	"diploma-back/internal/storage"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OriginalKey is the content addressed key of a user's original image
+func OriginalKey(userID uint, checksum string, ext string) string {
+	return fmt.Sprintf("users/%d/original/sha256/%s%s", userID, checksum, strings.ToLower(ext))
+}
+
+// ClaimOriginal adds a reference to the stored copy of an uploaded
+// original and returns its key. The first upload of some content is copied
+// from its staged key, later uploads reuse the stored copy. The copy is
+// made while the transaction holds the row, so concurrent claims of the
+// same content wait until it exists and a failed copy leaves no row. The
+// copy must match the checksum the caller validated, a staged object
+// replaced in the meantime fails with storage.ErrChecksumMismatch. The
+// staged object is left for the caller to delete.
+func ClaimOriginal(ctx context.Context, db *gorm.DB, store storage.ObjectStore, userID uint, stagedKey string, checksum string, size int64) (string, error) {
+	original := models.Original{
+		UserID:    userID,
+		SHA256:    checksum,
+		ObjectKey: OriginalKey(userID, checksum, path.Ext(stagedKey)),
+		Size:      size,
+		RefCount:  1,
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// The upsert locks the row until the transaction ends
+		err := tx.Clauses(
+			clause.OnConflict{
+				Columns: []clause.Column{{Name: "user_id"}, {Name: "sha256"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{
+					"ref_count":  gorm.Expr("originals.ref_count + 1"),
+					"updated_at": time.Now(),
+				}),
+			},
+			clause.Returning{},
+		).Create(&original).Error
+		if err != nil {
+			return fmt.Errorf("failed to save original: %w", err)
+		}
+		if original.RefCount > 1 {
+			return nil
+		}
+
+		if err := store.CopyObject(ctx, stagedKey, original.ObjectKey); err != nil {
+			return fmt.Errorf("failed to store original: %w", err)
+		}
+		info, err := store.Stat(ctx, original.ObjectKey)
+		if err == nil && info.SHA256 != checksum {
+			err = fmt.Errorf("%w: %s changed after validation", storage.ErrChecksumMismatch, stagedKey)
+		}
+		if err != nil {
+			store.DeleteFile(ctx, original.ObjectKey)
+			return fmt.Errorf("failed to store original: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return original.ObjectKey, nil
+}
+
+// ReleaseOriginal drops a job's reference to its original image and
+// deletes the object once no job references it. Originals stored before
+// deduplication belong to a single job and are deleted right away.
+func ReleaseOriginal(ctx context.Context, db *gorm.DB, store storage.ObjectStore, objectKey string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// The row lock keeps a concurrent claim from reusing the object
+		// while it is deleted
+		var original models.Original
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("object_key = ?", objectKey).First(&original).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return store.DeleteFile(ctx, objectKey)
+		}
+		if err != nil {
+			return err
+		}
+
+		if original.RefCount > 1 {
+			return tx.Model(&original).Update("ref_count", gorm.Expr("ref_count - 1")).Error
+		}
+
+		if err := store.DeleteFile(ctx, original.ObjectKey); err != nil {
+			return err
+		}
+		return tx.Delete(&original).Error
+	})
+}
@@ -0,0 +1,399 @@
+package artifacts
+
+import (
+	"context"
+	"diploma-back/internal/models"
+	"diploma-back/internal/storage"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Artifact types with a retention period
+const (
+	TypeOriginal  = "original"
+	TypeInputNii  = "input_nii"
+	TypeOutputNii = "output_nii"
+	TypePNG       = "png"
+)
+
+// Policy is how long each artifact type is kept after its job was created,
+// artifact types without a positive period are kept forever
+type Policy map[string]time.Duration
+
+// PolicyFromEnv reads the retention periods from RETENTION_ORIGINAL,
+// RETENTION_INPUT_NII, RETENTION_OUTPUT_NII and RETENTION_PNG, as Go
+// durations such as 720h
+func PolicyFromEnv() Policy {
+	return Policy{
+		TypeOriginal:  envDuration("RETENTION_ORIGINAL", 0),
+		TypeInputNii:  envDuration("RETENTION_INPUT_NII", 0),
+		TypeOutputNii: envDuration("RETENTION_OUTPUT_NII", 0),
+		TypePNG:       envDuration("RETENTION_PNG", 0),
+	}
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// PartsPrefix returns the key prefix of the parts of a resumable upload
+func PartsPrefix(upload *models.Upload) string {
+	return fmt.Sprintf("users/%d/parts/%d/", upload.UserID, upload.ID)
+}
+
+// Report is the outcome of one janitor run
+type Report struct {
+	StartedAt      time.Time            `json:"started_at"`
+	FinishedAt     time.Time            `json:"finished_at"`
+	Expired        map[string]int       `json:"expired"` // deleted objects per artifact type
+	ExpiredJobs    int                  `json:"expired_jobs"`
+	ExpiredUploads int                  `json:"expired_uploads"`
+	Orphans        []storage.ObjectInfo `json:"orphans"`
+	OrphansDeleted bool                 `json:"orphans_deleted"`
+	Errors         []string             `json:"errors,omitempty"`
+}
+
+func (r *Report) fail(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Printf("janitor: %s", message)
+	r.Errors = append(r.Errors, message)
+}
+
+// Janitor deletes stored artifacts whose retention period ended, abandoned
+// uploads, and objects under users/ that no row references, and corrects
+// the usage records from the listing of users/. Unreferenced
+// objects younger than ORPHAN_GRACE_PERIOD (default 24h) are left alone as
+// they may belong to a request in flight. Orphans are only reported unless
+// DELETE_ORPHANS=true.
+type Janitor struct {
+	db            *gorm.DB
+	store         storage.ObjectStore
+	policy        Policy
+	orphanGrace   time.Duration
+	deleteOrphans bool
+
+	runMu    sync.Mutex
+	reportMu sync.RWMutex
+	last     *Report
+}
+
+func NewJanitor(db *gorm.DB, store storage.ObjectStore) *Janitor {
+	return &Janitor{
+		db:            db,
+		store:         store,
+		policy:        PolicyFromEnv(),
+		orphanGrace:   envDuration("ORPHAN_GRACE_PERIOD", 24*time.Hour),
+		deleteOrphans: os.Getenv("DELETE_ORPHANS") == "true",
+	}
+}
+
+// Policy returns the retention periods in use
+func (j *Janitor) Policy() Policy {
+	return j.policy
+}
+
+// Start runs the janitor every JANITOR_INTERVAL (default 1h) until the
+// context is done
+func (j *Janitor) Start(ctx context.Context) {
+	interval := envDuration("JANITOR_INTERVAL", time.Hour)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			j.Run(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// LastReport returns the report of the latest run, nil before the first
+func (j *Janitor) LastReport() *Report {
+	j.reportMu.RLock()
+	defer j.reportMu.RUnlock()
+	return j.last
+}
+
+// Run expires artifacts and uploads, reconciles usage and looks for
+// orphans once
+func (j *Janitor) Run(ctx context.Context) *Report {
+	j.runMu.Lock()
+	defer j.runMu.Unlock()
+
+	report := &Report{
+		StartedAt:      time.Now(),
+		Expired:        map[string]int{},
+		OrphansDeleted: j.deleteOrphans,
+	}
+
+	for _, artifactType := range []string{TypeOriginal, TypeInputNii, TypeOutputNii, TypePNG} {
+		if period := j.policy[artifactType]; period > 0 {
+			j.expireArtifacts(ctx, artifactType, report.StartedAt.Add(-period), report)
+		}
+	}
+	j.expireUploads(ctx, report)
+
+	listedAt := time.Now()
+	objects, err := j.store.List(ctx, "users/")
+	if err != nil {
+		report.fail("failed to list objects: %v", err)
+	} else {
+		if err := reconcileUsage(j.db, objects, listedAt); err != nil {
+			report.fail("failed to reconcile usage: %v", err)
+		}
+		j.findOrphans(ctx, objects, report)
+	}
+
+	report.FinishedAt = time.Now()
+	log.Printf("janitor: expired %v, %d jobs, %d uploads, %d orphans", report.Expired, report.ExpiredJobs, report.ExpiredUploads, len(report.Orphans))
+
+	j.reportMu.Lock()
+	j.last = report
+	j.reportMu.Unlock()
+
+	return report
+}
+
+// expireArtifacts removes one artifact type of the finished jobs created
+// before cutoff. Jobs whose output expired are marked expired.
+func (j *Janitor) expireArtifacts(ctx context.Context, artifactType string, cutoff time.Time, report *Report) {
+	query := j.db.Where("created_at < ? AND status IN ?", cutoff, []string{"completed", "failed", "expired"})
+	switch artifactType {
+	case TypeOriginal:
+		query = query.Where("original_image_url <> ''")
+	case TypeInputNii:
+		query = query.Where("input_nii_path <> ''")
+	case TypeOutputNii:
+		query = query.Where("(output_nii_path <> '' OR EXISTS (SELECT 1 FROM processing_results WHERE processing_results.job_id = processing_jobs.id AND processing_results.output_nii_path <> ''))")
+	case TypePNG:
+		query = query.Where("(result_image_url <> '' OR EXISTS (SELECT 1 FROM processing_results WHERE processing_results.job_id = processing_jobs.id AND processing_results.result_image_url <> ''))")
+	}
+
+	var jobs []models.ProcessingJob
+	if err := query.Find(&jobs).Error; err != nil {
+		report.fail("failed to list jobs with expired %s: %v", artifactType, err)
+		return
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+		switch artifactType {
+		case TypeOriginal:
+			if err := ReleaseOriginal(ctx, j.db, j.store, job.OriginalImageURL); err != nil {
+				report.fail("failed to release original of job %d: %v", job.ID, err)
+				continue
+			}
+			j.db.Model(job).Update("original_image_url", "")
+			report.Expired[artifactType]++
+		case TypeInputNii:
+			key := job.InputNiiPath
+			j.db.Model(job).Update("input_nii_path", "")
+			j.deleteUnreferenced(ctx, key, artifactType, report)
+		case TypeOutputNii:
+			j.expireResults(ctx, job, "output_nii_path", artifactType, report)
+		case TypePNG:
+			j.expireResults(ctx, job, "result_image_url", artifactType, report)
+		}
+	}
+}
+
+// expireResults clears an artifact column of a job and its results and
+// deletes the objects. Without its output NII a result cannot be
+// downloaded anymore, so completed results and jobs are marked expired.
+func (j *Janitor) expireResults(ctx context.Context, job *models.ProcessingJob, column string, artifactType string, report *Report) {
+	var results []models.ProcessingResult
+	if err := j.db.Where("job_id = ?", job.ID).Find(&results).Error; err != nil {
+		report.fail("failed to list results of job %d: %v", job.ID, err)
+		return
+	}
+
+	keys := map[string]bool{}
+	jobUpdates := map[string]interface{}{column: ""}
+	if column == "output_nii_path" {
+		keys[job.OutputNiiPath] = true
+		if job.Status == "completed" {
+			jobUpdates["status"] = "expired"
+			report.ExpiredJobs++
+		}
+	} else {
+		keys[job.ResultImageURL] = true
+	}
+
+	for i := range results {
+		result := &results[i]
+		resultUpdates := map[string]interface{}{column: ""}
+		if column == "output_nii_path" {
+			keys[result.OutputNiiPath] = true
+			if result.Status == "completed" {
+				resultUpdates["status"] = "expired"
+			}
+		} else {
+			keys[result.ResultImageURL] = true
+		}
+		j.db.Model(result).Updates(resultUpdates)
+	}
+	j.db.Model(job).Updates(jobUpdates)
+
+	for key := range keys {
+		if key != "" {
+			j.deleteUnreferenced(ctx, key, artifactType, report)
+		}
+	}
+}
+
+// deleteUnreferenced deletes an artifact unless another job still
+// references it, as jobs reusing an earlier result share its objects
+func (j *Janitor) deleteUnreferenced(ctx context.Context, key string, artifactType string, report *Report) {
+	var count int64
+	if err := j.db.Unscoped().Model(&models.ProcessingJob{}).
+		Where("input_nii_path = ? OR output_nii_path = ? OR result_image_url = ?", key, key, key).
+		Count(&count).Error; err != nil || count > 0 {
+		return
+	}
+	if err := j.db.Model(&models.ProcessingResult{}).
+		Where("output_nii_path = ? OR result_image_url = ?", key, key).
+		Count(&count).Error; err != nil || count > 0 {
+		return
+	}
+
+	if err := j.store.DeleteFile(ctx, key); err != nil {
+		report.fail("failed to delete %s: %v", key, err)
+		return
+	}
+	report.Expired[artifactType]++
+}
+
+// expireUploads fails uploads that were never completed and deletes what
+// was uploaded
+func (j *Janitor) expireUploads(ctx context.Context, report *Report) {
+	var uploads []models.Upload
+	if err := j.db.Where("status = ? AND expires_at < ?", "pending", time.Now()).Find(&uploads).Error; err != nil {
+		report.fail("failed to list expired uploads: %v", err)
+		return
+	}
+
+	for i := range uploads {
+		upload := &uploads[i]
+
+		claim := j.db.Model(upload).Where("status = ?", "pending").Updates(map[string]interface{}{
+			"status":        "failed",
+			"error_message": "Upload expired",
+		})
+		if claim.Error != nil || claim.RowsAffected == 0 {
+			continue
+		}
+
+		if upload.Size > 0 {
+			parts, err := j.store.List(ctx, PartsPrefix(upload))
+			if err != nil {
+				report.fail("failed to list parts of upload %d: %v", upload.ID, err)
+			}
+			for _, part := range parts {
+				j.store.DeleteFile(ctx, part.Key)
+			}
+		}
+		if err := j.store.DeleteFile(ctx, upload.ObjectKey); err != nil {
+			report.fail("failed to delete upload %d: %v", upload.ID, err)
+		}
+		report.ExpiredUploads++
+	}
+}
+
+// findOrphans reports objects under users/ that no job, result, original
+// or open upload references, deleting them with DELETE_ORPHANS=true.
+// Comparison difference maps are never referenced and end up here too.
+func (j *Janitor) findOrphans(ctx context.Context, objects []storage.ObjectInfo, report *Report) {
+	referenced, prefixes, err := j.referencedKeys()
+	if err != nil {
+		report.fail("failed to collect referenced objects: %v", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-j.orphanGrace)
+	for _, object := range objects {
+		if referenced[object.Key] || object.LastModified.After(cutoff) || hasAnyPrefix(object.Key, prefixes) {
+			continue
+		}
+
+		report.Orphans = append(report.Orphans, object)
+		if j.deleteOrphans {
+			if err := j.store.DeleteFile(ctx, object.Key); err != nil {
+				report.fail("failed to delete orphan %s: %v", object.Key, err)
+			}
+		}
+	}
+}
+
+// referencedKeys returns every key stored in the database, and the parts
+// prefixes of open resumable uploads
+func (j *Janitor) referencedKeys() (map[string]bool, []string, error) {
+	referenced := map[string]bool{}
+	add := func(keys ...string) {
+		for _, key := range keys {
+			if key != "" {
+				referenced[key] = true
+			}
+		}
+	}
+
+	var jobs []models.ProcessingJob
+	if err := j.db.Unscoped().Select("original_image_url", "input_nii_path", "output_nii_path", "result_image_url").Find(&jobs).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, job := range jobs {
+		add(job.OriginalImageURL, job.InputNiiPath, job.OutputNiiPath, job.ResultImageURL)
+	}
+
+	var results []models.ProcessingResult
+	if err := j.db.Select("output_nii_path", "result_image_url").Find(&results).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, result := range results {
+		add(result.OutputNiiPath, result.ResultImageURL)
+	}
+
+	var originals []models.Original
+	if err := j.db.Select("object_key").Find(&originals).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, original := range originals {
+		add(original.ObjectKey)
+	}
+
+	var uploads []models.Upload
+	if err := j.db.Where("status IN ?", []string{"pending", "completing"}).Find(&uploads).Error; err != nil {
+		return nil, nil, err
+	}
+	var prefixes []string
+	for i := range uploads {
+		add(uploads[i].ObjectKey)
+		if uploads[i].Size > 0 {
+			prefixes = append(prefixes, PartsPrefix(&uploads[i]))
+		}
+	}
+
+	return referenced, prefixes, nil
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+package artifacts
+
+import (
+	"context"
+	"diploma-back/internal/models"
+	"diploma-back/internal/storage"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Artifact types without a retention period, counted in usage
+const (
+	TypeCompare = "compare"
+	TypeParts   = "upload_parts"
+)
+
+// artifactDirs maps the folder under users/<id>/ to its artifact type
+var artifactDirs = map[string]string{
+	"original":  TypeOriginal,
+	"input":     TypeInputNii,
+	"output":    TypeOutputNii,
+	"outputPNG": TypePNG,
+	"compare":   TypeCompare,
+	"parts":     TypeParts,
+}
+
+// ErrQuotaExceeded is returned when an upload does not fit a user's quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// parseKey returns the user and artifact type of a users/<id>/<type>/ key
+func parseKey(key string) (uint, string, bool) {
+	parts := strings.SplitN(key, "/", 4)
+	if len(parts) < 4 || parts[0] != "users" {
+		return 0, "", false
+	}
+	userID, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	artifactType, ok := artifactDirs[parts[2]]
+	return uint(userID), artifactType, ok
+}
+
+// AccountedStore records the size of every object written under a user's
+// prefix, so usage is summed without listing the bucket. Objects uploaded
+// straight to storage through presigned URLs are recorded once the API
+// copies them to their final key.
+type AccountedStore struct {
+	storage.ObjectStore
+	db *gorm.DB
+}
+
+func NewAccountedStore(db *gorm.DB, store storage.ObjectStore) *AccountedStore {
+	return &AccountedStore{ObjectStore: store, db: db}
+}
+
+// UploadFile uploads a file and records its size
+func (s *AccountedStore) UploadFile(ctx context.Context, objectName string, filePath string, contentType string) (string, error) {
+	key, err := s.ObjectStore.UploadFile(ctx, objectName, filePath, contentType)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(filePath); err == nil {
+		s.record(objectName, info.Size())
+	}
+	return key, nil
+}
+
+// UploadFromReader uploads from a reader and records the bytes read
+func (s *AccountedStore) UploadFromReader(ctx context.Context, objectName string, reader io.Reader, size int64, contentType string) (string, error) {
+	counter := &countingReader{reader: reader}
+	key, err := s.ObjectStore.UploadFromReader(ctx, objectName, counter, size, contentType)
+	if err != nil {
+		return "", err
+	}
+	s.record(objectName, counter.n)
+	return key, nil
+}
+
+// CopyObject copies an object and records the copy
+func (s *AccountedStore) CopyObject(ctx context.Context, srcName string, destName string) error {
+	if err := s.ObjectStore.CopyObject(ctx, srcName, destName); err != nil {
+		return err
+	}
+	if info, err := s.ObjectStore.Stat(ctx, destName); err == nil {
+		s.record(destName, info.Size)
+	}
+	return nil
+}
+
+// DeleteFile deletes an object and its record
+func (s *AccountedStore) DeleteFile(ctx context.Context, objectName string) error {
+	if err := s.ObjectStore.DeleteFile(ctx, objectName); err != nil {
+		return err
+	}
+	s.db.Where("key = ?", objectName).Delete(&models.StoredObject{})
+	return nil
+}
+
+func (s *AccountedStore) record(key string, size int64) {
+	if err := recordObject(s.db, key, size); err != nil {
+		log.Printf("usage: failed to record %s: %v", key, err)
+	}
+}
+
+// recordObject saves the size of an object, keys outside users/ are not
+// accounted
+func recordObject(db *gorm.DB, key string, size int64) error {
+	userID, artifactType, ok := parseKey(key)
+	if !ok {
+		return nil
+	}
+
+	object := models.StoredObject{
+		UserID:       userID,
+		Key:          key,
+		ArtifactType: artifactType,
+		Size:         size,
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"size", "updated_at"}),
+	}).Create(&object).Error
+}
+
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// TypeUsage is the number and total size of a user's objects of one type
+type TypeUsage struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Usage sums the stored objects of a user by artifact type
+func Usage(db *gorm.DB, userID uint) (map[string]TypeUsage, error) {
+	var rows []struct {
+		ArtifactType string
+		Count        int64
+		Bytes        int64
+	}
+	err := db.Model(&models.StoredObject{}).
+		Select("artifact_type, COUNT(*) AS count, COALESCE(SUM(size), 0) AS bytes").
+		Where("user_id = ?", userID).
+		Group("artifact_type").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	usage := map[string]TypeUsage{}
+	for _, row := range rows {
+		usage[row.ArtifactType] = TypeUsage{Count: row.Count, Bytes: row.Bytes}
+	}
+	return usage, nil
+}
+
+// UsedBytes is the total size of a user's stored objects
+func UsedBytes(db *gorm.DB, userID uint) (int64, error) {
+	var used int64
+	err := db.Model(&models.StoredObject{}).
+		Select("COALESCE(SUM(size), 0)").
+		Where("user_id = ?", userID).
+		Scan(&used).Error
+	return used, err
+}
+
+// Quota returns a user's storage quota in bytes, the user's own quota or
+// STORAGE_QUOTA_BYTES (default 0). Zero means unlimited.
+func Quota(db *gorm.DB, userID uint) (int64, error) {
+	var user models.User
+	if err := db.Select("storage_quota").First(&user, userID).Error; err != nil {
+		return 0, err
+	}
+	if user.StorageQuota != nil {
+		return *user.StorageQuota, nil
+	}
+
+	quota, _ := strconv.ParseInt(os.Getenv("STORAGE_QUOTA_BYTES"), 10, 64)
+	if quota < 0 {
+		quota = 0
+	}
+	return quota, nil
+}
+
+// RemainingQuota returns how many more bytes a user may store, -1 when the
+// quota is unlimited
+func RemainingQuota(db *gorm.DB, userID uint) (int64, error) {
+	quota, err := Quota(db, userID)
+	if err != nil || quota <= 0 {
+		return -1, err
+	}
+
+	used, err := UsedBytes(db, userID)
+	if err != nil {
+		return 0, err
+	}
+	if used >= quota {
+		return 0, nil
+	}
+	return quota - used, nil
+}
+
+// CheckQuota returns ErrQuotaExceeded when size more bytes do not fit the
+// user's quota
+func CheckQuota(db *gorm.DB, userID uint, size int64) error {
+	remaining, err := RemainingQuota(db, userID)
+	if err != nil {
+		return fmt.Errorf("failed to check quota: %w", err)
+	}
+	if remaining >= 0 && size > remaining {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// reconcileUsage makes the usage records match a listing of users/, which
+// also accounts objects stored before usage was recorded
+func reconcileUsage(db *gorm.DB, objects []storage.ObjectInfo, listedAt time.Time) error {
+	var records []models.StoredObject
+	if err := db.Select("id", "key", "size", "created_at").Find(&records).Error; err != nil {
+		return err
+	}
+	sizes := make(map[string]int64, len(records))
+	for _, record := range records {
+		sizes[record.Key] = record.Size
+	}
+
+	listed := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		listed[object.Key] = true
+		if size, ok := sizes[object.Key]; ok && size == object.Size {
+			continue
+		}
+		if err := recordObject(db, object.Key, object.Size); err != nil {
+			return err
+		}
+	}
+
+	// Records newer than the listing are uploads that finished meanwhile
+	for _, record := range records {
+		if !listed[record.Key] && record.CreatedAt.Before(listedAt) {
+			db.Delete(&models.StoredObject{}, record.ID)
+		}
+	}
+	return nil
+}
@@ -4,7 +4,9 @@ package database
 import (
 	"diploma-back/internal/models"
 	"fmt"
+	"log"
 	"os"
+	"strings"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -31,5 +33,45 @@ func MigrateDB(db *gorm.DB) error {
 	return db.AutoMigrate(
 		&models.User{},
 		&models.ProcessingJob{},
+		&models.ImageMetadata{},
+		&models.Original{},
+		&models.Model{},
+		&models.ProcessingResult{},
+		&models.Upload{},
+		&models.StoredObject{},
 	)
 }
+
+// GrantAdmins bootstraps admin rights for the registered users listed in
+// ADMIN_EMAILS (comma separated) while no admin exists yet. Email
+// addresses are not verified, so rights are never derived from the address
+// on each request, and once an admin exists further admins are flagged in
+// the database.
+func GrantAdmins(db *gorm.DB) error {
+	var emails []string
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			emails = append(emails, email)
+		}
+	}
+	if len(emails) == 0 {
+		return nil
+	}
+
+	var admins int64
+	if err := db.Model(&models.User{}).Where("is_admin = ?", true).Count(&admins).Error; err != nil {
+		return err
+	}
+	if admins > 0 {
+		return nil
+	}
+
+	result := db.Model(&models.User{}).
+		Where("LOWER(email) IN ?", emails).
+		Update("is_admin", true)
+	if result.Error != nil {
+		return result.Error
+	}
+	log.Printf("Granted admin rights to %d users from ADMIN_EMAILS", result.RowsAffected)
+	return nil
+}
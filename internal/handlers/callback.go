@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"diploma-back/internal/models"
+	"diploma-back/internal/registry"
+	"diploma-back/internal/storage"
+	"diploma-back/pkg/imaging"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// callbackMaxSkew is how far the callback timestamp may be from now
+	callbackMaxSkew = 5 * time.Minute
+	// callbackHeaderMargin allows for the NIfTI header and extensions of a
+	// callback body
+	callbackHeaderMargin = 1 << 20
+)
+
+// JobResultCallback receives the output of an asynchronous model run and
+// resumes the pipeline with validation, upload and PNG rendering.
+//
+// The request is signed with CALLBACK_SECRET: X-Callback-Timestamp holds
+// the unix time and X-Callback-Signature is "sha256=" followed by the hex
+// HMAC-SHA256 of "<timestamp>.<request URI>." and the body. A JSON body
+// {"error": "..."} reports a failed run, any other body is the output NIfTI.
+// The body may hold at most the input's voxels as float64, and a result is
+// delivered once: it moves to "delivering" before it is processed.
+func JobResultCallback(db *gorm.DB, store storage.ObjectStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret := os.Getenv("CALLBACK_SECRET")
+		if secret == "" {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Callbacks are not configured"})
+			return
+		}
+
+		timestamp := c.GetHeader("X-Callback-Timestamp")
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(unix, 0)).Abs() > callbackMaxSkew {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired timestamp"})
+			return
+		}
+
+		signature, err := hex.DecodeString(strings.TrimPrefix(c.GetHeader("X-Callback-Signature"), "sha256="))
+		if err != nil || len(signature) == 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+			return
+		}
+
+		var job models.ProcessingJob
+		if err := db.First(&job, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+
+		var result models.ProcessingResult
+		if err := db.Where("id = ? AND job_id = ?", c.Query("result"), job.ID).First(&result).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Result not found"})
+			return
+		}
+
+		if result.Status != "processing" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Result was already delivered"})
+			return
+		}
+
+		ctx := context.Background()
+
+		maxSize, err := callbackMaxSize(ctx, store, &job)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read input"})
+			return
+		}
+
+		// Spool the body to disk while computing the signature
+		mac := hmac.New(sha256.New, []byte(secret))
+		fmt.Fprintf(mac, "%s.%s.", timestamp, c.Request.URL.RequestURI())
+
+		outputNiiPath := filepath.Join("/tmp", fmt.Sprintf("%s_output.nii", uuid.New().String()))
+		outputFile, err := os.Create(outputNiiPath)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save result"})
+			return
+		}
+		defer os.Remove(outputNiiPath)
+
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, maxSize)
+		_, err = io.Copy(io.MultiWriter(outputFile, mac), body)
+		outputFile.Close()
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Result exceeds %d bytes", maxSize)})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read result"})
+			return
+		}
+
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+			return
+		}
+
+		// Claim the result so a replayed or concurrent callback cannot
+		// deliver it twice
+		claim := db.Model(&result).Where("status = ?", "processing").Update("status", "delivering")
+		if claim.Error != nil || claim.RowsAffected == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Result was already delivered"})
+			return
+		}
+
+		// The batch system reports failures as JSON
+		if mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type")); mediaType == "application/json" {
+			var failure struct {
+				Error string `json:"error"`
+			}
+			body, _ := os.ReadFile(outputNiiPath)
+			if err := json.Unmarshal(body, &failure); err != nil || failure.Error == "" {
+				db.Model(&result).Update("status", "processing")
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a NIfTI file or an error message"})
+				return
+			}
+
+			result.Status = "failed"
+			result.ErrorMessage = fmt.Sprintf("Model error: %s", failure.Error)
+			db.Save(&result)
+			finishJob(db, &job)
+
+			c.JSON(http.StatusOK, gin.H{"status": result.Status})
+			return
+		}
+
+		var spec *imaging.OutputSpec
+		if result.ModelID != nil {
+			var model models.Model
+			if err := db.Unscoped().First(&model, *result.ModelID).Error; err == nil {
+				spec, err = registry.OutputSpecFor(&model)
+				if err != nil {
+					db.Model(&result).Update("status", "processing")
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+			}
+		}
+
+		// Download input NII for validation against its geometry
+		inputNiiPath := filepath.Join("/tmp", fmt.Sprintf("cb_%d_%s.nii", job.ID, uuid.New().String()))
+		if err := store.DownloadFile(ctx, job.InputNiiPath, inputNiiPath); err != nil {
+			db.Model(&result).Update("status", "processing")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to download input"})
+			return
+		}
+		defer os.Remove(inputNiiPath)
+
+		storeModelOutput(ctx, db, store, &job, &result, spec, inputNiiPath, outputNiiPath)
+		finishJob(db, &job)
+
+		if result.Status != "completed" {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": result.ErrorMessage})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": result.Status})
+	}
+}
+
+// callbackMaxSize is the largest callback body accepted for a job, an
+// output with the input's voxels as float64
+func callbackMaxSize(ctx context.Context, store storage.ObjectStore, job *models.ProcessingJob) (int64, error) {
+	input, err := store.GetObject(ctx, job.InputNiiPath)
+	if err != nil {
+		return 0, err
+	}
+	defer input.Close()
+
+	header, err := imaging.DecodeNifti(input, true)
+	if err != nil {
+		return 0, err
+	}
+	return int64(header.NumVoxels())*int64(imaging.Float64.Size()) + callbackHeaderMargin, nil
+}
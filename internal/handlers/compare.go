@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"context"
+	"diploma-back/internal/models"
+	"diploma-back/internal/storage"
+	"diploma-back/pkg/imaging"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func CompareResults(db *gorm.DB, store storage.ObjectStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userID")
+		jobIDA := c.Query("a")
+		jobIDB := c.Query("b")
+
+		if jobIDA == "" || jobIDB == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Both a and b job IDs are required"})
+			return
+		}
+
+		if jobIDA == jobIDB {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot compare a job with itself"})
+			return
+		}
+
+		var jobA, jobB models.ProcessingJob
+		if err := db.Where("id = ? AND user_id = ?", jobIDA, userID).First(&jobA).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Job %s not found", jobIDA)})
+			return
+		}
+		if err := db.Where("id = ? AND user_id = ?", jobIDB, userID).First(&jobB).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Job %s not found", jobIDB)})
+			return
+		}
+
+		if jobA.Status != "completed" || jobB.Status != "completed" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Both jobs must be completed"})
+			return
+		}
+
+		ctx := context.Background()
+
+		// Download both output volumes
+		tempNiiPathA := filepath.Join("/tmp", fmt.Sprintf("cmp_%d_%s.nii", jobA.ID, uuid.New().String()))
+		if err := store.DownloadFile(ctx, jobA.OutputNiiPath, tempNiiPathA); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": resultReadError(err)})
+			return
+		}
+		defer os.Remove(tempNiiPathA)
+
+		tempNiiPathB := filepath.Join("/tmp", fmt.Sprintf("cmp_%d_%s.nii", jobB.ID, uuid.New().String()))
+		if err := store.DownloadFile(ctx, jobB.OutputNiiPath, tempNiiPathB); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": resultReadError(err)})
+			return
+		}
+		defer os.Remove(tempNiiPathB)
+
+		comparison, diffPath, err := imaging.CompareNii(tempNiiPathA, tempNiiPathB)
+		if err != nil {
+			if errors.Is(err, imaging.ErrIncompatibleGeometry) {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compare results"})
+			return
+		}
+		defer os.Remove(diffPath)
+
+		diffObjectName := fmt.Sprintf("users/%d/compare/%d_%d_%s.png", userID, jobA.ID, jobB.ID, uuid.New().String())
+		if _, err := store.UploadFile(ctx, diffObjectName, diffPath, "image/png"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload difference map"})
+			return
+		}
+
+		diffURL, err := store.GetPresignedURL(ctx, diffObjectName)
+		if err != nil {
+			fmt.Printf("error: %v", err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"job_a":              jobA.ID,
+			"job_b":              jobB.ID,
+			"shape":              comparison.Shape,
+			"spacing":            comparison.Spacing,
+			"voxel_volume_mm3":   comparison.VoxelVolumeMM3,
+			"labels":             comparison.Labels,
+			"difference_map_url": diffURL,
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"diploma-back/internal/models"
+	"os"
+
+	"gorm.io/gorm"
+)
+
+// reuseResults is whether a job may reuse the completed result of an
+// earlier job of the same user on identical content with the same model
+// version, set with DEDUP_REUSE_RESULTS=true
+func reuseResults() bool {
+	return os.Getenv("DEDUP_REUSE_RESULTS") == "true"
+}
+
+// findReusableResult returns the latest completed result of the user's
+// model version on an original with the given checksum
+func findReusableResult(db *gorm.DB, userID uint, checksum string, modelName string, modelVersion string) (*models.ProcessingResult, error) {
+	var result models.ProcessingResult
+	err := db.Joins("JOIN processing_jobs ON processing_jobs.id = processing_results.job_id AND processing_jobs.deleted_at IS NULL").
+		Joins("JOIN image_metadata ON image_metadata.job_id = processing_jobs.id").
+		Where("processing_jobs.user_id = ? AND image_metadata.sha256 = ?", userID, checksum).
+		Where("processing_results.status = ? AND processing_results.model_name = ? AND processing_results.model_version = ?", "completed", modelName, modelVersion).
+		Order("processing_results.id DESC").
+		First(&result).Error
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"context"
+	"diploma-back/internal/storage"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RotateStorageKeys re-encrypts every stored object written with an older
+// key, or before encryption was enabled, with the current key. It runs in
+// the background, one rotation at a time, and logs its progress.
+func RotateStorageKeys(store *storage.MinIOClient) gin.HandlerFunc {
+	var running atomic.Bool
+
+	return func(c *gin.Context) {
+		if !running.CompareAndSwap(false, true) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Key rotation is already running"})
+			return
+		}
+
+		go func() {
+			defer running.Store(false)
+			ctx := context.Background()
+
+			objects, err := store.List(ctx, "")
+			if err != nil {
+				log.Printf("key rotation: %v", err)
+				return
+			}
+
+			rotated, failed := 0, 0
+			for _, object := range objects {
+				changed, err := store.RotateKey(ctx, object.Key)
+				if err != nil {
+					log.Printf("key rotation: %s: %v", object.Key, err)
+					failed++
+					continue
+				}
+				if changed {
+					rotated++
+				}
+			}
+			log.Printf("key rotation: %d of %d objects re-encrypted, %d failed", rotated, len(objects), failed)
+		}()
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "Key rotation started"})
+	}
+}
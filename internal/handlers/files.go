@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"diploma-back/internal/storage"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServeLocalFile serves objects of the local store through the presigned
+// URLs it hands out
+func ServeLocalFile(store *storage.LocalStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("key"), "/")
+
+		if err := store.VerifyURL(http.MethodGet, key, c.Query("expires"), "", c.Query("signature")); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired URL"})
+			return
+		}
+
+		info, err := store.Stat(c.Request.Context(), key)
+		if err != nil {
+			if errors.Is(err, storage.ErrObjectNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get file"})
+			return
+		}
+
+		object, err := store.GetObject(c.Request.Context(), key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get file"})
+			return
+		}
+		defer object.Close()
+
+		c.DataFromReader(http.StatusOK, info.Size, info.ContentType, object, nil)
+	}
+}
+
+// ReceiveLocalFile stores a file PUT to a presigned upload URL of the local
+// store
+func ReceiveLocalFile(store *storage.LocalStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("key"), "/")
+
+		if err := store.VerifyURL(http.MethodPut, key, c.Query("expires"), c.Query("max_size"), c.Query("signature")); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired URL"})
+			return
+		}
+
+		maxSize, err := strconv.ParseInt(c.Query("max_size"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired URL"})
+			return
+		}
+		if c.Request.ContentLength > maxSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Uploads are limited to %d bytes", maxSize)})
+			return
+		}
+
+		contentType := c.ContentType()
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, maxSize)
+		if _, err := store.UploadFromReader(c.Request.Context(), key, body, c.Request.ContentLength, contentType); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Uploads are limited to %d bytes", maxSize)})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store file"})
+			return
+		}
+
+		c.Status(http.StatusOK)
+	}
+}
+
+// ServeObject streams one of the user's objects through the API, for the
+// links handed out in proxy mode
+func ServeObject(store storage.ObjectStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("key"), "/")
+
+		// Users only reach objects under their own prefix
+		if path.Clean("/" + key)[1:] != key || !strings.HasPrefix(key, fmt.Sprintf("users/%d/", c.GetUint("userID"))) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+
+		info, err := store.Stat(c.Request.Context(), key)
+		if err != nil {
+			if errors.Is(err, storage.ErrObjectNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get file"})
+			return
+		}
+
+		object, err := store.GetObject(c.Request.Context(), key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get file"})
+			return
+		}
+		defer object.Close()
+
+		c.Header("Cache-Control", "private")
+		c.DataFromReader(http.StatusOK, info.Size, info.ContentType, object, nil)
+	}
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"diploma-back/internal/registry"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Health reports the state of every model backend. The overall status is
+// "degraded" while any model's circuit breaker is not closed. Error details
+// are only included when detailed is set, as they may reveal internal
+// addresses.
+func Health(reg *registry.Registry, detailed bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status := "ok"
+		response := []gin.H{}
+		for _, model := range reg.Statuses() {
+			if model.State != registry.StateClosed {
+				status = "degraded"
+			}
+
+			entry := gin.H{
+				"model_id": model.ModelID,
+				"name":     model.Name,
+				"version":  model.Version,
+				"state":    model.State,
+				"healthy":  model.State == registry.StateClosed,
+			}
+			if !model.LastCheck.IsZero() {
+				entry["last_check"] = model.LastCheck
+			}
+			if detailed {
+				entry["backend"] = model.Backend
+				entry["consecutive_failures"] = model.Failures
+				entry["last_error"] = model.LastError
+			}
+			response = append(response, entry)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": status,
+			"models": response,
+		})
+	}
+}
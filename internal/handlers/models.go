@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"diploma-back/internal/models"
+	"diploma-back/internal/registry"
+	"diploma-back/pkg/imaging"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type ModelRequest struct {
+	Name       string      `json:"name" binding:"required"`
+	Version    string      `json:"version" binding:"required"`
+	Backend    string      `json:"backend" binding:"required,oneof=http kserve grpc callback stub"`
+	Endpoint   string      `json:"endpoint"`
+	InputSpec  models.JSON `json:"input_spec"`
+	OutputSpec models.JSON `json:"output_spec"`
+	LabelMap   models.JSON `json:"label_map"`
+	Enabled    *bool       `json:"enabled"`
+}
+
+func (req *ModelRequest) apply(model *models.Model) {
+	model.Name = req.Name
+	model.Version = req.Version
+	model.Backend = req.Backend
+	model.Endpoint = req.Endpoint
+	model.InputSpec = req.InputSpec
+	model.OutputSpec = req.OutputSpec
+	model.LabelMap = req.LabelMap
+	if req.Enabled != nil {
+		model.Enabled = *req.Enabled
+	}
+}
+
+func bindModelRequest(c *gin.Context) (*ModelRequest, bool) {
+	var req ModelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	if req.Backend != "stub" && req.Endpoint == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Endpoint is required"})
+		return nil, false
+	}
+
+	if len(req.InputSpec) > 0 {
+		var spec registry.InputSpec
+		if err := json.Unmarshal(req.InputSpec, &spec); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "input_spec must be a JSON object"})
+			return nil, false
+		}
+		if spec.BatchSize > 1 && req.Backend != "kserve" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Batching is only supported by the kserve backend"})
+			return nil, false
+		}
+		if spec.BatchSize < 0 || spec.BatchWait < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "batch_size and batch_wait_ms must not be negative"})
+			return nil, false
+		}
+	}
+
+	if len(req.OutputSpec) > 0 {
+		var spec imaging.OutputSpec
+		if err := json.Unmarshal(req.OutputSpec, &spec); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "output_spec must be a JSON object"})
+			return nil, false
+		}
+	}
+
+	if len(req.LabelMap) > 0 {
+		var labels map[string]string
+		if err := json.Unmarshal(req.LabelMap, &labels); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "label_map must map label values to names"})
+			return nil, false
+		}
+		for key := range labels {
+			if _, err := strconv.Atoi(key); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "label_map keys must be integer label values"})
+				return nil, false
+			}
+		}
+	}
+
+	return &req, true
+}
+
+// ListModels returns the enabled models users can choose from
+func ListModels(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var registered []models.Model
+		if err := db.Where("enabled = ?", true).Order("name, created_at DESC").Find(&registered).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch models"})
+			return
+		}
+
+		c.JSON(http.StatusOK, registered)
+	}
+}
+
+func AdminListModels(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var registered []models.Model
+		if err := db.Order("name, created_at DESC").Find(&registered).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch models"})
+			return
+		}
+
+		c.JSON(http.StatusOK, registered)
+	}
+}
+
+func CreateModel(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, ok := bindModelRequest(c)
+		if !ok {
+			return
+		}
+
+		var existing models.Model
+		if err := db.Unscoped().Where("name = ? AND version = ?", req.Name, req.Version).First(&existing).Error; err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Model version already registered"})
+			return
+		}
+
+		model := models.Model{Enabled: true}
+		req.apply(&model)
+
+		if err := db.Create(&model).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create model"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, model)
+	}
+}
+
+func UpdateModel(db *gorm.DB, reg *registry.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var model models.Model
+		if err := db.First(&model, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Model not found"})
+			return
+		}
+
+		req, ok := bindModelRequest(c)
+		if !ok {
+			return
+		}
+
+		var existing models.Model
+		if err := db.Unscoped().Where("name = ? AND version = ? AND id <> ?", req.Name, req.Version, model.ID).First(&existing).Error; err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Model version already registered"})
+			return
+		}
+
+		req.apply(&model)
+
+		if err := db.Save(&model).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update model"})
+			return
+		}
+		reg.Invalidate(model.ID)
+
+		c.JSON(http.StatusOK, model)
+	}
+}
+
+func DeleteModel(db *gorm.DB, reg *registry.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var model models.Model
+		if err := db.First(&model, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Model not found"})
+			return
+		}
+
+		if err := db.Delete(&model).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete model"})
+			return
+		}
+		reg.Invalidate(model.ID)
+
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -2,90 +2,348 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"diploma-back/internal/artifacts"
 	"diploma-back/internal/models"
+	"diploma-back/internal/registry"
 	"diploma-back/internal/storage"
 	"diploma-back/pkg/imaging"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
-func UploadImage(db *gorm.DB, minioClient *storage.MinIOClient) gin.HandlerFunc {
+// maxFormValueSize limits the model fields of an upload form
+const maxFormValueSize = 1 << 10
+
+func UploadImage(db *gorm.DB, store storage.ObjectStore, reg *registry.Registry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.GetUint("userID")
+		ctx := context.Background()
 
-		file, err := c.FormFile("image")
+		// Read the form as a stream so the image goes straight to storage
+		form, err := c.Request.MultipartReader()
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "No image file provided"})
 			return
 		}
 
-		// Validate file type
-		ext := filepath.Ext(file.Filename)
-		if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Only JPEG and PNG files are allowed"})
-			return
+		var objectName, modelVersion string
+		var requested []string
+		var meta *imaging.Metadata
+		// A MetaImage header (.mhd) waits for its data file in image_data
+		var mhdHeader []byte
+		var mhdName string
+		reject := func(status int, message string) {
+			if objectName != "" {
+				store.DeleteFile(ctx, objectName)
+			}
+			c.JSON(status, gin.H{"error": message})
 		}
 
-		// Generate unique filename
-		uniqueID := uuid.New().String()
-		filename := fmt.Sprintf("%s%s", uniqueID, ext)
-		tempPath := filepath.Join("/tmp", filename)
+		for {
+			part, err := form.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				reject(http.StatusBadRequest, "Malformed upload form")
+				return
+			}
 
-		// Save file temporarily
-		if err := c.SaveUploadedFile(file, tempPath); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
-			return
+			switch part.FormName() {
+			case "model", "model_version":
+				value, err := io.ReadAll(io.LimitReader(part, maxFormValueSize+1))
+				if err != nil || len(value) > maxFormValueSize {
+					part.Close()
+					reject(http.StatusBadRequest, "Malformed upload form")
+					return
+				}
+				if part.FormName() == "model" {
+					requested = append(requested, string(value))
+				} else {
+					modelVersion = string(value)
+				}
+			case "image":
+				if objectName != "" || mhdHeader != nil {
+					part.Close()
+					reject(http.StatusBadRequest, "Only one image can be uploaded at a time")
+					return
+				}
+				if strings.EqualFold(filepath.Ext(part.FileName()), ".mhd") {
+					header, err := io.ReadAll(io.LimitReader(part, imaging.UploadHeaderSize+1))
+					if err != nil || len(header) == 0 || len(header) > imaging.UploadHeaderSize {
+						part.Close()
+						reject(http.StatusBadRequest, "Invalid image: failed to read MetaImage header")
+						return
+					}
+					mhdHeader, mhdName = header, part.FileName()
+					break
+				}
+				var ok bool
+				objectName, meta, ok = storeOriginal(c, db, store, userID, part.FileName(), part)
+				if !ok {
+					part.Close()
+					return
+				}
+			case "image_data":
+				if mhdHeader == nil || objectName != "" {
+					part.Close()
+					reject(http.StatusBadRequest, "image_data must follow a MetaImage header (.mhd) in image")
+					return
+				}
+				// Store the header and its data as one .mha file
+				header, err := imaging.InlineMetaImageHeader(mhdHeader, part.FileName())
+				if err != nil {
+					part.Close()
+					reject(http.StatusBadRequest, fmt.Sprintf("Invalid image: %s", err.Error()))
+					return
+				}
+				filename := strings.TrimSuffix(mhdName, filepath.Ext(mhdName)) + ".mha"
+				var ok bool
+				objectName, meta, ok = storeOriginal(c, db, store, userID, filename, io.MultiReader(bytes.NewReader(header), part))
+				if !ok {
+					part.Close()
+					return
+				}
+			}
+			part.Close()
 		}
-		defer os.Remove(tempPath) // Clean up temp file
 
-		// Validate image
-		if err := imaging.ValidateImageFile(tempPath); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid image: %s", err.Error())})
+		if objectName == "" && mhdHeader != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "MetaImage header (.mhd) needs its data file in image_data"})
+			return
+		}
+		if objectName == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No image file provided"})
 			return
 		}
 
-		// Upload to MinIO
-		ctx := context.Background()
-		objectName := fmt.Sprintf("users/%d/original/%s", userID, filename)
-
-		contentType := "image/jpeg"
-		if ext == ".png" {
-			contentType = "image/png"
+		// Select models once the whole form is read, the fields may follow
+		// the file. The default backend is used when none is given.
+		selections, err := resolveModels(reg, requested, modelVersion)
+		if err != nil {
+			if errors.Is(err, registry.ErrModelNotFound) || errors.Is(err, errTooManyModels) {
+				reject(http.StatusBadRequest, err.Error())
+				return
+			}
+			reject(http.StatusInternalServerError, "Failed to load model")
+			return
 		}
+		defer releaseSelections(selections)
 
-		_, err = minioClient.UploadFile(ctx, objectName, tempPath, contentType)
+		job, err := startJob(db, store, userID, objectName, meta, selections)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload to storage"})
+			reject(http.StatusInternalServerError, err.Error())
 			return
 		}
 
-		// Create processing job
-		job := &models.ProcessingJob{
-			UserID:           userID,
-			OriginalImageURL: objectName,
-			Status:           "processing",
+		c.JSON(http.StatusOK, jobStartedResponse(job, selections))
+	}
+}
+
+// storeOriginal validates the image from its first bytes and streams it to
+// storage while computing its size and checksum, up to the user's
+// remaining storage quota. It writes the error
+// response and returns false when the image is rejected.
+func storeOriginal(c *gin.Context, db *gorm.DB, store storage.ObjectStore, userID uint, filename string, image io.Reader) (string, *imaging.Metadata, bool) {
+	// Validate file type
+	ext := strings.ToLower(filepath.Ext(filename))
+	contentType, ok := imaging.UploadContentType(ext)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only JPEG, PNG, TIFF, WebP, NRRD and MetaImage (.mha, or .mhd with image_data) files are allowed"})
+		return "", nil, false
+	}
+
+	// Validate image and read what metadata its header holds
+	reader := bufio.NewReaderSize(image, imaging.UploadHeaderSize)
+	header, err := reader.Peek(imaging.UploadHeaderSize)
+	if err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read image"})
+		return "", nil, false
+	}
+	meta, err := imaging.InspectUpload(header, ext)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid image: %s", err.Error())})
+		return "", nil, false
+	}
+
+	remaining, err := artifacts.RemainingQuota(db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+		return "", nil, false
+	}
+	if remaining == 0 {
+		quotaExceeded(c, db, userID)
+		return "", nil, false
+	}
+
+	// Upload to storage
+	ctx := context.Background()
+	objectName := fmt.Sprintf("users/%d/original/%s%s", userID, uuid.New().String(), ext)
+
+	var source io.Reader = reader
+	if remaining > 0 {
+		source = io.LimitReader(reader, remaining+1)
+	}
+	hash := sha256.New()
+	body := &countingReader{reader: io.TeeReader(source, hash)}
+	if _, err := store.UploadFromReader(ctx, objectName, body, -1, contentType); err != nil {
+		store.DeleteFile(ctx, objectName)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload to storage"})
+		return "", nil, false
+	}
+	if remaining > 0 && body.n > remaining {
+		store.DeleteFile(ctx, objectName)
+		quotaExceeded(c, db, userID)
+		return "", nil, false
+	}
+
+	meta.FileSize = body.n
+	meta.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return objectName, meta, true
+}
+
+// errOriginalChanged is returned by startJob when the staged original no
+// longer holds the validated content
+var errOriginalChanged = errors.New("File changed after it was validated")
+
+// startJob creates the processing job for an original image staged in
+// storage, with its metadata and one result per selected model, and starts
+// processing in the background. The original is moved to its content
+// addressed key, and with DEDUP_REUSE_RESULTS models that already processed
+// the same content for the user reuse their earlier result. The staged
+// object is deleted whether or not the job starts.
+func startJob(db *gorm.DB, store storage.ObjectStore, userID uint, objectName string, meta *imaging.Metadata, selections []*registry.Selection) (*models.ProcessingJob, error) {
+	ctx := context.Background()
+	selection := selections[0]
+
+	originalName, err := artifacts.ClaimOriginal(ctx, db, store, userID, objectName, meta.SHA256, meta.FileSize)
+	// The staged object is either copied or rejected now
+	if originalName != objectName {
+		store.DeleteFile(ctx, objectName)
+	}
+	if err != nil {
+		fmt.Printf("error: %v", err)
+		if errors.Is(err, storage.ErrChecksumMismatch) {
+			return nil, errOriginalChanged
 		}
+		return nil, errors.New("Failed to store original image")
+	}
 
-		if err := db.Create(&job).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create processing job"})
-			return
+	// Find earlier results before this job's metadata can match itself
+	reused := make([]*models.ProcessingResult, len(selections))
+	if reuseResults() {
+		for i, selection := range selections {
+			reused[i], _ = findReusableResult(db, userID, meta.SHA256, selection.Name, selection.Version)
 		}
+	}
 
-		// Process in goroutine
-		go processImageAsync(db, job, minioClient)
+	// Create processing job
+	job := &models.ProcessingJob{
+		UserID:           userID,
+		OriginalImageURL: originalName,
+		Status:           "processing",
+		ModelID:          selection.ModelID,
+		ModelName:        selection.Name,
+		ModelVersion:     selection.Version,
+	}
 
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Processing started",
-			"job_id":  job.ID,
-			"status":  "processing",
-		})
+	// Create the job with its metadata and results together, so a failure
+	// never leaves a job without the results it is finished from
+	results := make([]*models.ProcessingResult, len(selections))
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&job).Error; err != nil {
+			return errors.New("Failed to create processing job")
+		}
+
+		metadata := newImageMetadata(job.ID, meta)
+		if err := tx.Create(metadata).Error; err != nil {
+			return errors.New("Failed to save image metadata")
+		}
+
+		for i, selection := range selections {
+			result := &models.ProcessingResult{
+				JobID:        job.ID,
+				ModelID:      selection.ModelID,
+				ModelName:    selection.Name,
+				ModelVersion: selection.Version,
+				Status:       "processing",
+			}
+			if earlier := reused[i]; earlier != nil {
+				result.OutputNiiPath = earlier.OutputNiiPath
+				result.ResultImageURL = earlier.ResultImageURL
+				result.Status = "completed"
+			}
+			if err := tx.Create(result).Error; err != nil {
+				return errors.New("Failed to create processing job")
+			}
+			results[i] = result
+		}
+		return nil
+	})
+	if err != nil {
+		artifacts.ReleaseOriginal(ctx, db, store, originalName)
+		return nil, err
+	}
+
+	runs := make([]modelRun, 0, len(selections))
+	for i, selection := range selections {
+		if result := results[i]; result.Status == "processing" {
+			runs = append(runs, modelRun{result: result, backend: selection.Backend, spec: selection.OutputSpec, breaker: selection.Breaker, release: selection.Hold()})
+		}
+	}
+
+	// Every model reused an earlier result, share that job's input too
+	if len(runs) == 0 {
+		var earlier models.ProcessingJob
+		if err := db.First(&earlier, reused[0].JobID).Error; err == nil {
+			job.InputNiiPath = earlier.InputNiiPath
+		}
+		finishJob(db, job)
+		return job, nil
+	}
+
+	// Process in goroutine
+	go processImageAsync(db, job, store, runs)
+
+	return job, nil
+}
+
+func jobStartedResponse(job *models.ProcessingJob, selections []*registry.Selection) gin.H {
+	modelNames := make([]string, len(selections))
+	for i, selection := range selections {
+		modelNames[i] = selection.Name + ":" + selection.Version
+	}
+
+	message := "Processing started"
+	if job.Status == "completed" {
+		message = "Reused earlier results"
+	}
+
+	return gin.H{
+		"message":       message,
+		"job_id":        job.ID,
+		"status":        job.Status,
+		"model_name":    job.ModelName,
+		"model_version": job.ModelVersion,
+		"models":        modelNames,
 	}
 }
 
@@ -129,89 +387,440 @@ func UploadImage(db *gorm.DB, minioClient *storage.MinIOClient) gin.HandlerFunc
 // 	}
 // }
 
-func processImageAsync(db *gorm.DB, job *models.ProcessingJob, minioClient *storage.MinIOClient) {
+// modelRun is one model inference requested for a job
+type modelRun struct {
+	result  *models.ProcessingResult
+	backend imaging.InferenceBackend
+	spec    *imaging.OutputSpec
+	breaker *registry.Breaker
+	release func() // ends the run's hold on its backend
+}
+
+func processImageAsync(db *gorm.DB, job *models.ProcessingJob, store storage.ObjectStore, runs []modelRun) {
 	ctx := context.Background()
+	defer func() {
+		for _, run := range runs {
+			run.release()
+		}
+	}()
 
-	// Download original image from MinIO
-	tempImagePath := filepath.Join("/tmp", fmt.Sprintf("img_%d_%s", job.ID, uuid.New().String()))
-	err := minioClient.DownloadFile(ctx, job.OriginalImageURL, tempImagePath)
+	// Download original image from storage
+	tempImagePath := filepath.Join("/tmp", fmt.Sprintf("img_%d_%s%s", job.ID, uuid.New().String(), path.Ext(job.OriginalImageURL)))
+	err := store.DownloadFile(ctx, job.OriginalImageURL, tempImagePath)
 	if err != nil {
-		job.Status = "failed"
-		job.ErrorMessage = fmt.Sprintf("Failed to download image: %s", err.Error())
-		db.Save(job)
+		failJob(db, job, runs, fmt.Sprintf("Failed to download image: %s", err.Error()))
 		return
 	}
 	defer os.Remove(tempImagePath)
 
+	// Complete metadata the upload header did not hold
+	if err := completeMetadata(db, job, tempImagePath); err != nil {
+		failJob(db, job, runs, fmt.Sprintf("Failed to read image metadata: %s", err.Error()))
+		return
+	}
+
 	// Convert image to NII
 	inputNiiPath, err := imaging.ConvertToNii(tempImagePath)
 	if err != nil {
-		job.Status = "failed"
-		job.ErrorMessage = fmt.Sprintf("Conversion error: %s", err.Error())
-		db.Save(job)
+		failJob(db, job, runs, fmt.Sprintf("Conversion error: %s", err.Error()))
 		return
 	}
 	defer os.Remove(inputNiiPath)
 
-	// Upload input NII to MinIO
+	// Upload input NII to storage
 	inputNiiObjectName := fmt.Sprintf("users/%d/input/%s.nii", job.UserID, uuid.New().String())
-	_, err = minioClient.UploadFile(ctx, inputNiiObjectName, inputNiiPath, "application/octet-stream")
+	_, err = store.UploadFile(ctx, inputNiiObjectName, inputNiiPath, "application/octet-stream")
 	if err != nil {
-		job.Status = "failed"
-		job.ErrorMessage = fmt.Sprintf("Failed to upload input NII: %s", err.Error())
-		db.Save(job)
+		failJob(db, job, runs, fmt.Sprintf("Failed to upload input NII: %s", err.Error()))
 		return
 	}
 
 	job.InputNiiPath = inputNiiObjectName
 	db.Save(job)
 
-	// Call model
-	outputNiiPath, err := imaging.CallModel(inputNiiPath)
+	inputHeader, err := imaging.ReadNiftiHeader(inputNiiPath)
 	if err != nil {
-		job.Status = "failed"
-		job.ErrorMessage = fmt.Sprintf("Model error: %s", err.Error())
-		db.Save(job)
+		failJob(db, job, runs, fmt.Sprintf("Failed to read input NII: %s", err.Error()))
+		return
+	}
+
+	// Run every requested model on the same input
+	var wg sync.WaitGroup
+	for _, run := range runs {
+		wg.Add(1)
+		go func(run modelRun) {
+			defer wg.Done()
+
+			// Hold the run while the model's circuit breaker is open
+			if err := waitForModel(ctx, run.breaker); err != nil {
+				run.result.Status = "failed"
+				run.result.ErrorMessage = fmt.Sprintf("Model unavailable: %s", err.Error())
+				db.Save(run.result)
+				return
+			}
+
+			var modelErr error
+			if async, ok := run.backend.(imaging.AsyncBackend); ok {
+				modelErr = submitModel(ctx, db, job, run, async, inputNiiPath)
+			} else if streaming, ok := run.backend.(imaging.StreamingBackend); ok {
+				modelErr = runModelStream(ctx, db, store, job, run, streaming, inputHeader)
+			} else {
+				modelErr = runModel(ctx, db, store, job, run, inputNiiPath)
+			}
+
+			switch {
+			case errors.Is(modelErr, errModelNotExercised):
+				run.breaker.Abandon()
+			case modelErr != nil:
+				run.breaker.RecordFailure(modelErr)
+			default:
+				run.breaker.RecordSuccess()
+			}
+		}(run)
+	}
+	wg.Wait()
+
+	finishJob(db, job)
+}
+
+// finishJob updates the job from its model results once none is still
+// processing. The first completed result is the job's primary result, a
+// job without one fails with the first model's error.
+func finishJob(db *gorm.DB, job *models.ProcessingJob) {
+	var results []models.ProcessingResult
+	if err := db.Where("job_id = ?", job.ID).Order("id").Find(&results).Error; err != nil || len(results) == 0 {
 		return
 	}
+
+	for _, result := range results {
+		if result.Status == "processing" || result.Status == "delivering" {
+			return
+		}
+	}
+
+	for _, result := range results {
+		if result.Status == "completed" {
+			job.Status = "completed"
+			job.OutputNiiPath = result.OutputNiiPath
+			job.ResultImageURL = result.ResultImageURL
+			db.Save(job)
+			return
+		}
+	}
+
+	job.Status = "failed"
+	job.ErrorMessage = results[0].ErrorMessage
+	db.Save(job)
+}
+
+// errModelNotExercised is returned by a model run that failed before the
+// model could answer, e.g. because the input could not be read, which says
+// nothing about the model's health
+var errModelNotExercised = errors.New("model not exercised")
+
+// waitForModel waits until the model's circuit breaker lets a call through,
+// at most MODEL_UNAVAILABLE_WAIT (default 10m)
+func waitForModel(ctx context.Context, breaker *registry.Breaker) error {
+	wait := 10 * time.Minute
+	if value, err := time.ParseDuration(os.Getenv("MODEL_UNAVAILABLE_WAIT")); err == nil {
+		wait = value
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	if err := breaker.Wait(ctx); err != nil {
+		return fmt.Errorf("model server unhealthy for %s: %s", wait, breaker.Status().LastError)
+	}
+	return nil
+}
+
+// submitModel hands the input to an asynchronous backend. The result stays
+// processing until the backend calls JobResultCallback. It returns the
+// model call error, if any.
+func submitModel(ctx context.Context, db *gorm.DB, job *models.ProcessingJob, run modelRun, backend imaging.AsyncBackend, inputNiiPath string) error {
+	result := run.result
+
+	callbackPath := fmt.Sprintf("/api/internal/jobs/%d/result?result=%d", job.ID, result.ID)
+	if err := backend.Submit(ctx, inputNiiPath, callbackPath); err != nil {
+		result.Status = "failed"
+		result.ErrorMessage = fmt.Sprintf("Model error: %s", err.Error())
+		db.Save(result)
+		return err
+	}
+	return nil
+}
+
+// runModel runs one model on the input NII and stores its outputs. It
+// returns the model call error, if any.
+func runModel(ctx context.Context, db *gorm.DB, store storage.ObjectStore, job *models.ProcessingJob, run modelRun, inputNiiPath string) error {
+	result := run.result
+
+	// Call model
+	outputNiiPath, err := run.backend.Infer(ctx, inputNiiPath)
+	if err != nil {
+		result.Status = "failed"
+		result.ErrorMessage = fmt.Sprintf("Model error: %s", err.Error())
+		db.Save(result)
+		return err
+	}
 	defer os.Remove(outputNiiPath)
 
-	// Upload output NII to MinIO
+	storeModelOutput(ctx, db, store, job, result, run.spec, inputNiiPath, outputNiiPath)
+	return nil
+}
+
+// storeModelOutput validates a model output, uploads it with its PNG
+// preview and completes the result
+func storeModelOutput(ctx context.Context, db *gorm.DB, store storage.ObjectStore, job *models.ProcessingJob, result *models.ProcessingResult, spec *imaging.OutputSpec, inputNiiPath string, outputNiiPath string) {
+	// Validate output against the input geometry and the model's spec
+	if err := imaging.ValidateOutput(inputNiiPath, outputNiiPath, spec); err != nil {
+		result.Status = "failed"
+		result.ErrorMessage = err.Error()
+		db.Save(result)
+		return
+	}
+
+	// Upload output NII to storage
 	outputNiiObjectName := fmt.Sprintf("users/%d/output/%s.nii", job.UserID, uuid.New().String())
-	_, err = minioClient.UploadFile(ctx, outputNiiObjectName, outputNiiPath, "application/octet-stream")
+	_, err := store.UploadFile(ctx, outputNiiObjectName, outputNiiPath, "application/octet-stream")
 	if err != nil {
-		job.Status = "failed"
-		job.ErrorMessage = fmt.Sprintf("Failed to upload output NII: %s", err.Error())
-		db.Save(job)
+		result.Status = "failed"
+		result.ErrorMessage = fmt.Sprintf("Failed to upload output NII: %s", err.Error())
+		db.Save(result)
 		return
 	}
 
 	pngPath, err := imaging.ConvertNiiToImage(outputNiiPath, "png")
 	if err != nil {
-		job.Status = "failed"
-		job.ErrorMessage = fmt.Sprintf("Failed to convert NII to PNG: %s", err.Error())
-		db.Save(job)
+		result.Status = "failed"
+		result.ErrorMessage = fmt.Sprintf("Failed to convert NII to PNG: %s", err.Error())
+		db.Save(result)
 		return
 	}
 	defer os.Remove(pngPath)
 
 	outputPNGObjectName := fmt.Sprintf("users/%d/outputPNG/%s.png", job.UserID, uuid.New().String())
-	_, err = minioClient.UploadFile(ctx, outputPNGObjectName, pngPath, "application/octet-stream")
+	_, err = store.UploadFile(ctx, outputPNGObjectName, pngPath, "application/octet-stream")
 	if err != nil {
-		job.Status = "failed"
-		job.ErrorMessage = fmt.Sprintf("Failed to upload output PNG: %s", err.Error())
-		db.Save(job)
+		result.Status = "failed"
+		result.ErrorMessage = fmt.Sprintf("Failed to upload output PNG: %s", err.Error())
+		db.Save(result)
 		return
 	}
 
-	// Update job
-	job.OutputNiiPath = outputNiiObjectName
-	job.ResultImageURL = outputPNGObjectName
-	job.Status = "completed"
+	// Update result
+	result.OutputNiiPath = outputNiiObjectName
+	result.ResultImageURL = outputPNGObjectName
+	result.Status = "completed"
+	db.Save(result)
+}
+
+// runModelStream streams the input NII from storage through the model and
+// the model output straight back to storage, validating it on the way, so no
+// volume is written to disk or held in memory. It returns the model call
+// error, if any, or errModelNotExercised when the input cannot be read.
+func runModelStream(ctx context.Context, db *gorm.DB, store storage.ObjectStore, job *models.ProcessingJob, run modelRun, backend imaging.StreamingBackend, inputHeader *imaging.Volume) error {
+	result := run.result
+
+	input, err := store.GetObject(ctx, job.InputNiiPath)
+	if err != nil {
+		result.Status = "failed"
+		result.ErrorMessage = fmt.Sprintf("Failed to read input NII: %s", err.Error())
+		db.Save(result)
+		return errModelNotExercised
+	}
+	defer input.Close()
+
+	// Call model
+	inputReader := &errorReader{reader: input}
+	output, err := backend.InferStream(ctx, inputReader, path.Base(job.InputNiiPath))
+	if err != nil {
+		result.Status = "failed"
+		if inputReader.err != nil {
+			result.ErrorMessage = fmt.Sprintf("Failed to read input NII: %s", inputReader.err.Error())
+			db.Save(result)
+			return errModelNotExercised
+		}
+		result.ErrorMessage = fmt.Sprintf("Model error: %s", err.Error())
+		db.Save(result)
+		return err
+	}
+	defer output.Close()
+
+	// Upload output NII to storage while validating it against the input
+	// geometry and the model's spec
+	validator := imaging.NewStreamValidator(inputHeader, run.spec)
+	outputNiiObjectName := fmt.Sprintf("users/%d/output/%s.nii", job.UserID, uuid.New().String())
+	_, uploadErr := store.UploadFromReader(ctx, outputNiiObjectName, io.TeeReader(output, validator), -1, "application/octet-stream")
+	if err := validator.Err(); err != nil {
+		if uploadErr == nil {
+			store.DeleteFile(ctx, outputNiiObjectName)
+		}
+		result.Status = "failed"
+		result.ErrorMessage = err.Error()
+		db.Save(result)
+		return nil
+	}
+	if uploadErr != nil {
+		result.Status = "failed"
+		result.ErrorMessage = fmt.Sprintf("Failed to upload output NII: %s", uploadErr.Error())
+		db.Save(result)
+		return nil
+	}
+	if err := validator.Close(); err != nil {
+		store.DeleteFile(ctx, outputNiiObjectName)
+		result.Status = "failed"
+		result.ErrorMessage = err.Error()
+		db.Save(result)
+		return nil
+	}
+
+	// Render the preview from the slice kept by the validator
+	var pngBuffer bytes.Buffer
+	if err := validator.RenderPNG(&pngBuffer); err != nil {
+		result.Status = "failed"
+		result.ErrorMessage = fmt.Sprintf("Failed to convert NII to PNG: %s", err.Error())
+		db.Save(result)
+		return nil
+	}
+
+	outputPNGObjectName := fmt.Sprintf("users/%d/outputPNG/%s.png", job.UserID, uuid.New().String())
+	_, err = store.UploadFromReader(ctx, outputPNGObjectName, &pngBuffer, int64(pngBuffer.Len()), "application/octet-stream")
+	if err != nil {
+		result.Status = "failed"
+		result.ErrorMessage = fmt.Sprintf("Failed to upload output PNG: %s", err.Error())
+		db.Save(result)
+		return nil
+	}
+
+	// Update result
+	result.OutputNiiPath = outputNiiObjectName
+	result.ResultImageURL = outputPNGObjectName
+	result.Status = "completed"
+	db.Save(result)
+	return nil
+}
+
+// errorReader records the first error of a reader other than io.EOF
+type errorReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// failJob marks a job and all of its model runs as failed
+func failJob(db *gorm.DB, job *models.ProcessingJob, runs []modelRun, message string) {
+	for _, run := range runs {
+		run.result.Status = "failed"
+		run.result.ErrorMessage = message
+		db.Save(run.result)
+	}
+
+	job.Status = "failed"
+	job.ErrorMessage = message
 	db.Save(job)
 }
 
-func GetResult(db *gorm.DB, minioClient *storage.MinIOClient) gin.HandlerFunc {
+const maxModelsPerJob = 5
+
+var errTooManyModels = fmt.Errorf("at most %d models can be requested per upload", maxModelsPerJob)
+
+// resolveModels resolves the requested models, given as "name" or
+// "name:version". A single model may also take its version from
+// model_version. The selections are released with releaseSelections.
+func resolveModels(reg *registry.Registry, requested []string, version string) ([]*registry.Selection, error) {
+	if len(requested) == 0 {
+		requested = []string{""}
+	}
+	if len(requested) > maxModelsPerJob {
+		return nil, errTooManyModels
+	}
+
+	seen := map[string]bool{}
+	selections := make([]*registry.Selection, 0, len(requested))
+	for _, entry := range requested {
+		name, modelVersion, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if modelVersion == "" && len(requested) == 1 {
+			modelVersion = version
+		}
+
+		selection, err := reg.Resolve(name, modelVersion)
+		if err != nil {
+			releaseSelections(selections)
+			if errors.Is(err, registry.ErrModelNotFound) {
+				return nil, fmt.Errorf("%w: %s", err, entry)
+			}
+			return nil, err
+		}
+
+		key := selection.Name + ":" + selection.Version
+		if seen[key] {
+			selection.Release()
+			continue
+		}
+		seen[key] = true
+		selections = append(selections, selection)
+	}
+
+	return selections, nil
+}
+
+func releaseSelections(selections []*registry.Selection) {
+	for _, selection := range selections {
+		selection.Release()
+	}
+}
+
+// completeMetadata reads the full metadata of an original whose upload
+// header did not describe its dimensions
+func completeMetadata(db *gorm.DB, job *models.ProcessingJob, imagePath string) error {
+	var metadata models.ImageMetadata
+	if err := db.Where("job_id = ?", job.ID).First(&metadata).Error; err != nil || metadata.Width > 0 {
+		return nil
+	}
+
+	meta, err := imaging.ExtractMetadata(imagePath)
+	if err != nil {
+		return err
+	}
+
+	complete := newImageMetadata(job.ID, meta)
+	complete.ID = metadata.ID
+	complete.CreatedAt = metadata.CreatedAt
+	return db.Save(complete).Error
+}
+
+func newImageMetadata(jobID uint, meta *imaging.Metadata) *models.ImageMetadata {
+	spacing := make([]string, len(meta.Spacing))
+	for i, v := range meta.Spacing {
+		spacing[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+
+	return &models.ImageMetadata{
+		JobID:       jobID,
+		Format:      meta.Format,
+		Width:       meta.Width,
+		Height:      meta.Height,
+		Depth:       meta.Depth,
+		BitDepth:    meta.BitDepth,
+		ColorMode:   meta.ColorMode,
+		FileSize:    meta.FileSize,
+		SHA256:      meta.SHA256,
+		Spacing:     strings.Join(spacing, ","),
+		Orientation: meta.Orientation,
+		Modality:    meta.Modality,
+	}
+}
+
+func GetResult(db *gorm.DB, store storage.ObjectStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		jobID := c.Param("id")
 		userID := c.GetUint("userID")
@@ -223,17 +832,19 @@ func GetResult(db *gorm.DB, minioClient *storage.MinIOClient) gin.HandlerFunc {
 		}
 
 		response := gin.H{
-			"id":         job.ID,
-			"status":     job.Status,
-			"created_at": job.CreatedAt,
-			"updated_at": job.UpdatedAt,
+			"id":            job.ID,
+			"status":        job.Status,
+			"model_name":    job.ModelName,
+			"model_version": job.ModelVersion,
+			"created_at":    job.CreatedAt,
+			"updated_at":    job.UpdatedAt,
 		}
 
 		if job.Status == "completed" {
 			ctx := context.Background()
 
 			if job.ResultImageURL != "" {
-				url, err := minioClient.GetPresignedURL(ctx, job.ResultImageURL)
+				url, err := store.GetPresignedURL(ctx, job.ResultImageURL)
 				if err != nil {
 					fmt.Printf("error: %v", err)
 				}
@@ -241,7 +852,7 @@ func GetResult(db *gorm.DB, minioClient *storage.MinIOClient) gin.HandlerFunc {
 			}
 
 			if job.OriginalImageURL != "" {
-				url, err := minioClient.GetPresignedURL(ctx, job.OriginalImageURL)
+				url, err := store.GetPresignedURL(ctx, job.OriginalImageURL)
 				if err != nil {
 					fmt.Printf("error: %v", err)
 				}
@@ -252,12 +863,50 @@ func GetResult(db *gorm.DB, minioClient *storage.MinIOClient) gin.HandlerFunc {
 		if job.Status == "failed" {
 			response["error"] = job.ErrorMessage
 		}
+		if job.Status == "expired" {
+			response["error"] = "Results have expired"
+		}
+
+		var metadata models.ImageMetadata
+		if err := db.Where("job_id = ?", job.ID).First(&metadata).Error; err == nil {
+			response["metadata"] = metadata
+		}
+
+		var results []models.ProcessingResult
+		if err := db.Where("job_id = ?", job.ID).Order("id").Find(&results).Error; err == nil && len(results) > 0 {
+			ctx := context.Background()
+			items := make([]gin.H, 0, len(results))
+			for _, result := range results {
+				item := gin.H{
+					"id":            result.ID,
+					"model_id":      result.ModelID,
+					"model_name":    result.ModelName,
+					"model_version": result.ModelVersion,
+					"status":        result.Status,
+				}
+
+				if result.Status == "completed" && result.ResultImageURL != "" {
+					url, err := store.GetPresignedURL(ctx, result.ResultImageURL)
+					if err != nil {
+						fmt.Printf("error: %v", err)
+					}
+					item["result_image_url"] = url
+				}
+
+				if result.Status == "failed" {
+					item["error"] = result.ErrorMessage
+				}
+
+				items = append(items, item)
+			}
+			response["results"] = items
+		}
 
 		c.JSON(http.StatusOK, response)
 	}
 }
 
-func GetHistory(db *gorm.DB, minioClient *storage.MinIOClient) gin.HandlerFunc {
+func GetHistory(db *gorm.DB, store storage.ObjectStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID := c.GetUint("userID")
 		ctx := context.Background()
@@ -270,7 +919,7 @@ func GetHistory(db *gorm.DB, minioClient *storage.MinIOClient) gin.HandlerFunc {
 
 		for _, job := range jobs {
 			if job.ResultImageURL != "" {
-				url, err := minioClient.GetPresignedURL(ctx, job.ResultImageURL)
+				url, err := store.GetPresignedURL(ctx, job.ResultImageURL)
 				if err != nil {
 					fmt.Printf("error: %v", err)
 				}
@@ -278,7 +927,7 @@ func GetHistory(db *gorm.DB, minioClient *storage.MinIOClient) gin.HandlerFunc {
 			}
 
 			if job.OriginalImageURL != "" {
-				url, err := minioClient.GetPresignedURL(ctx, job.OriginalImageURL)
+				url, err := store.GetPresignedURL(ctx, job.OriginalImageURL)
 				if err != nil {
 					fmt.Printf("error: %v", err)
 				}
@@ -290,11 +939,16 @@ func GetHistory(db *gorm.DB, minioClient *storage.MinIOClient) gin.HandlerFunc {
 	}
 }
 
-func DownloadResult(db *gorm.DB, minioClient *storage.MinIOClient) gin.HandlerFunc {
+func DownloadResult(db *gorm.DB, store storage.ObjectStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		jobID := c.Param("id")
 		userID := c.GetUint("userID")
-		format := c.DefaultQuery("format", "nii") // nii or png
+		format := c.DefaultQuery("format", "nii") // nii, png, nrrd, mha or mhd
+
+		if format != "nii" && format != "png" && format != "nrrd" && format != "mha" && format != "mhd" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format, use nii, png, nrrd, mha or mhd"})
+			return
+		}
 
 		var job models.ProcessingJob
 		if err := db.Where("id = ? AND user_id = ?", jobID, userID).First(&job).Error; err != nil {
@@ -302,43 +956,84 @@ func DownloadResult(db *gorm.DB, minioClient *storage.MinIOClient) gin.HandlerFu
 			return
 		}
 
+		if job.Status == "expired" {
+			c.JSON(http.StatusGone, gin.H{"error": "Results have expired"})
+			return
+		}
 		if job.Status != "completed" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Job not completed"})
 			return
 		}
 
+		// A specific model's result can be selected in ensemble runs
+		if resultID := c.Query("result"); resultID != "" {
+			var result models.ProcessingResult
+			if err := db.Where("id = ? AND job_id = ?", resultID, job.ID).First(&result).Error; err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Result not found"})
+				return
+			}
+			if result.Status != "completed" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Result not completed"})
+				return
+			}
+			job.OutputNiiPath = result.OutputNiiPath
+		}
+
 		ctx := context.Background()
 
-		if format == "png" {
-			// Download NII, convert to PNG, serve
+		if format != "nii" {
+			// Download NII, convert to requested format, serve
 			tempNiiPath := filepath.Join("/tmp", fmt.Sprintf("nii_%s.nii", uuid.New().String()))
-			err := minioClient.DownloadFile(ctx, job.OutputNiiPath, tempNiiPath)
+			err := store.DownloadFile(ctx, job.OutputNiiPath, tempNiiPath)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to download result"})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": resultReadError(err)})
 				return
 			}
 			defer os.Remove(tempNiiPath)
 
-			pngPath, err := imaging.ConvertNiiToImage(tempNiiPath, "png")
+			convertedPath, err := imaging.ConvertNiiToImage(tempNiiPath, format)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to convert to PNG"})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to convert to %s", strings.ToUpper(format))})
 				return
 			}
-			defer os.Remove(pngPath)
+			defer os.Remove(convertedPath)
 
-			c.File(pngPath)
+			switch format {
+			case "png":
+				c.File(convertedPath)
+			case "mhd":
+				// The header and its data file come as one archive
+				c.FileAttachment(convertedPath, fmt.Sprintf("result_%d.zip", job.ID))
+			default:
+				c.FileAttachment(convertedPath, fmt.Sprintf("result_%d.%s", job.ID, format))
+			}
 		} else {
-			// Serve NII directly
-			obj, err := minioClient.GetObject(ctx, job.OutputNiiPath)
+			// Serve NII directly. With the length known, a checksum mismatch
+			// detected on the last read leaves the response short instead of
+			// complete.
+			info, err := store.Stat(ctx, job.OutputNiiPath)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get result"})
+				return
+			}
+			obj, err := store.GetObject(ctx, job.OutputNiiPath)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get result"})
 				return
 			}
 			defer obj.Close()
 
-			c.Header("Content-Type", "application/octet-stream")
 			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=result_%d.nii", job.ID))
-			c.DataFromReader(http.StatusOK, -1, "application/octet-stream", obj, nil)
+			c.DataFromReader(http.StatusOK, info.Size, "application/octet-stream", obj, nil)
 		}
 	}
 }
+
+// resultReadError describes a failed read of a stored result, telling a
+// corrupt result apart from a missing one
+func resultReadError(err error) string {
+	if errors.Is(err, storage.ErrChecksumMismatch) {
+		return "Result failed its integrity check"
+	}
+	return "Failed to download result"
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"context"
+	"diploma-back/internal/artifacts"
+	"diploma-back/internal/models"
+	"diploma-back/internal/storage"
+	"diploma-back/pkg/imaging"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Resumable uploads follow the core and creation parts of the tus 1.0.0
+// protocol (https://tus.io/protocols/resumable-upload). Each PATCH is
+// stored as a part object of its own, recorded on the upload together with
+// the new offset, and the recorded parts are joined into the original image
+// once all bytes have arrived. The upload is then
+// completed with POST /api/uploads/:id/complete like a presigned upload.
+const (
+	tusVersion = "1.0.0"
+	// maxResumableUploadSize is the largest file accepted as a resumable upload
+	maxResumableUploadSize = 4 << 30
+	// resumableUploadTTL is how long an unfinished resumable upload is kept
+	resumableUploadTTL = 24 * time.Hour
+)
+
+// CreateResumableUpload starts a resumable upload. The total size is given
+// in Upload-Length and the file name as base64 "filename" in
+// Upload-Metadata.
+func CreateResumableUpload(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userID")
+		c.Header("Tus-Resumable", tusVersion)
+
+		size, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+		if err != nil || size <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length header required"})
+			return
+		}
+		if size > maxResumableUploadSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Uploads are limited to %d bytes", maxResumableUploadSize)})
+			return
+		}
+
+		if !checkQuota(c, db, userID, size) {
+			return
+		}
+
+		filename := parseUploadMetadata(c.GetHeader("Upload-Metadata"))["filename"]
+
+		// Validate file type
+		ext := strings.ToLower(filepath.Ext(filename))
+		contentType, ok := imaging.UploadContentType(ext)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only JPEG, PNG, TIFF, WebP, NRRD and MetaImage (.mha) files are allowed, upload .mhd with its data file to /api/upload"})
+			return
+		}
+
+		upload := &models.Upload{
+			UserID:      userID,
+			ObjectKey:   fmt.Sprintf("users/%d/original/%s%s", userID, uuid.New().String(), ext),
+			Filename:    filepath.Base(filename),
+			ContentType: contentType,
+			Size:        size,
+			Status:      "pending",
+			ExpiresAt:   time.Now().Add(resumableUploadTTL),
+		}
+		if err := db.Create(upload).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+			return
+		}
+
+		c.Header("Location", fmt.Sprintf("/api/uploads/resumable/%d", upload.ID))
+		c.Header("Upload-Offset", "0")
+		c.JSON(http.StatusCreated, gin.H{
+			"upload_id":  upload.ID,
+			"offset":     0,
+			"size":       size,
+			"expires_at": upload.ExpiresAt,
+		})
+	}
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header, a comma
+// separated list of keys with base64 encoded values
+func parseUploadMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
+
+// findResumableUpload loads a resumable upload of the current user
+func findResumableUpload(c *gin.Context, db *gorm.DB) (*models.Upload, bool) {
+	var upload models.Upload
+	err := db.Where("id = ? AND user_id = ? AND size > 0", c.Param("id"), c.GetUint("userID")).First(&upload).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, false
+	}
+	if upload.Offset < upload.Size && time.Now().After(upload.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "Upload has expired"})
+		return nil, false
+	}
+	return &upload, true
+}
+
+// GetResumableUpload reports how many bytes were received, so a client can
+// resume after reconnecting
+func GetResumableUpload(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", tusVersion)
+		c.Header("Cache-Control", "no-store")
+
+		upload, ok := findResumableUpload(c, db)
+		if !ok {
+			return
+		}
+
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.Header("Upload-Length", strconv.FormatInt(upload.Size, 10))
+		c.Status(http.StatusOK)
+	}
+}
+
+// PatchResumableUpload appends a chunk at Upload-Offset. A chunk that is
+// interrupted is discarded and has to be sent again from the last offset.
+func PatchResumableUpload(db *gorm.DB, store storage.ObjectStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", tusVersion)
+
+		if c.ContentType() != "application/offset+octet-stream" {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+			return
+		}
+
+		upload, ok := findResumableUpload(c, db)
+		if !ok {
+			return
+		}
+
+		offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+		if err != nil || offset != upload.Offset {
+			c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			c.JSON(http.StatusConflict, gin.H{"error": "Upload-Offset does not match the received bytes", "offset": upload.Offset})
+			return
+		}
+		if upload.Offset == upload.Size {
+			c.JSON(http.StatusConflict, gin.H{"error": "Upload is already complete"})
+			return
+		}
+
+		ctx := context.Background()
+
+		// Store the chunk as a part named by its offset. A retried chunk may
+		// race its first attempt, so each request writes a key of its own.
+		remaining := upload.Size - upload.Offset
+		size := int64(-1)
+		if length := c.Request.ContentLength; length > remaining {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Chunk exceeds the remaining %d bytes", remaining)})
+			return
+		} else if length > 0 {
+			size = length
+		}
+
+		// Sessions reserve no quota, so every chunk has to fit what is left
+		quotaLeft, err := artifacts.RemainingQuota(db, upload.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+			return
+		}
+		limit := remaining
+		if quotaLeft >= 0 && quotaLeft < limit {
+			limit = quotaLeft
+		}
+		if size > limit || limit == 0 {
+			quotaExceeded(c, db, upload.UserID)
+			return
+		}
+
+		partName := fmt.Sprintf("%s%020d-%s", artifacts.PartsPrefix(upload), upload.Offset, uuid.New().String())
+		body := &countingReader{reader: io.LimitReader(c.Request.Body, limit+1)}
+		if _, err := store.UploadFromReader(ctx, partName, body, size, "application/octet-stream"); err != nil {
+			store.DeleteFile(ctx, partName)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+			return
+		}
+		if body.n == 0 || body.n > remaining {
+			store.DeleteFile(ctx, partName)
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Chunk must contain between 1 and %d bytes", remaining)})
+			return
+		}
+		if body.n > limit {
+			store.DeleteFile(ctx, partName)
+			quotaExceeded(c, db, upload.UserID)
+			return
+		}
+
+		// Advance the offset and record the part unless another request got
+		// there first
+		newOffset := upload.Offset + body.n
+		update := db.Model(&models.Upload{}).
+			Where("id = ? AND upload_offset = ?", upload.ID, upload.Offset).
+			Updates(map[string]interface{}{
+				"upload_offset": newOffset,
+				"parts":         gorm.Expr("parts || ?", partName+"\n"),
+			})
+		if update.Error != nil || update.RowsAffected == 0 {
+			store.DeleteFile(ctx, partName)
+			c.JSON(http.StatusConflict, gin.H{"error": "Upload was modified concurrently"})
+			return
+		}
+		upload.Offset = newOffset
+		upload.Parts += partName + "\n"
+
+		if upload.Offset == upload.Size {
+			if err := assembleParts(ctx, store, upload); err != nil {
+				fmt.Printf("error: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assemble upload"})
+				return
+			}
+		}
+
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.Status(http.StatusNoContent)
+	}
+}
+
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// assembleParts joins the recorded parts of a fully received upload into
+// its original image object and removes every part, including those of
+// requests that lost the race for an offset
+func assembleParts(ctx context.Context, store storage.ObjectStore, upload *models.Upload) error {
+	parts := strings.Fields(upload.Parts)
+	if len(parts) == 0 {
+		return fmt.Errorf("no parts found for upload %d", upload.ID)
+	}
+
+	readers := make([]io.Reader, 0, len(parts))
+	var total int64
+	for _, part := range parts {
+		info, err := store.Stat(ctx, part)
+		if err != nil {
+			return err
+		}
+		object, err := store.GetObject(ctx, part)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+		readers = append(readers, object)
+		total += info.Size
+	}
+	if total != upload.Size {
+		return fmt.Errorf("parts of upload %d hold %d bytes, expected %d", upload.ID, total, upload.Size)
+	}
+
+	if _, err := store.UploadFromReader(ctx, upload.ObjectKey, io.MultiReader(readers...), upload.Size, upload.ContentType); err != nil {
+		return err
+	}
+
+	stored, err := store.List(ctx, artifacts.PartsPrefix(upload))
+	if err != nil {
+		return err
+	}
+	for _, part := range stored {
+		store.DeleteFile(ctx, part.Key)
+	}
+	return nil
+}
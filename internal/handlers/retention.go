@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"context"
+	"diploma-back/internal/artifacts"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RetentionReport returns the retention periods and the latest janitor run
+func RetentionReport(janitor *artifacts.Janitor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy := gin.H{}
+		for artifactType, period := range janitor.Policy() {
+			if period > 0 {
+				policy[artifactType] = period.String()
+			} else {
+				policy[artifactType] = nil
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"policy":   policy,
+			"last_run": janitor.LastReport(),
+		})
+	}
+}
+
+// RunRetention runs the janitor now and returns its report
+func RunRetention(janitor *artifacts.Janitor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, janitor.Run(context.Background()))
+	}
+}
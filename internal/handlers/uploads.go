@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"context"
+	"diploma-back/internal/artifacts"
+	"diploma-back/internal/models"
+	"diploma-back/internal/registry"
+	"diploma-back/internal/storage"
+	"diploma-back/pkg/imaging"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// uploadURLTTL is how long a presigned upload URL stays valid
+	uploadURLTTL = 15 * time.Minute
+	// maxDirectUploadSize is the largest file accepted through a presigned URL
+	maxDirectUploadSize = 1 << 30
+)
+
+type CreateUploadRequest struct {
+	Filename string `json:"filename" binding:"required"`
+}
+
+type CompleteUploadRequest struct {
+	Models       []string `json:"models"`
+	ModelVersion string   `json:"model_version"`
+}
+
+// CreateUpload reserves an object key under users/{id}/original/ and
+// returns a presigned upload the client sends the file with. The store
+// rejects files larger than maxDirectUploadSize.
+func CreateUpload(db *gorm.DB, store storage.ObjectStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userID")
+
+		var req CreateUploadRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Validate file type
+		ext := strings.ToLower(filepath.Ext(req.Filename))
+		contentType, ok := imaging.UploadContentType(ext)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only JPEG, PNG, TIFF, WebP, NRRD and MetaImage (.mha) files are allowed, upload .mhd with its data file to /api/upload"})
+			return
+		}
+
+		if !checkQuota(c, db, userID, 1) {
+			return
+		}
+
+		objectName := fmt.Sprintf("users/%d/original/%s%s", userID, uuid.New().String(), ext)
+		target, err := store.PresignUpload(context.Background(), objectName, contentType, maxDirectUploadSize, uploadURLTTL)
+		if err != nil {
+			fmt.Printf("error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload URL"})
+			return
+		}
+
+		upload := &models.Upload{
+			UserID:      userID,
+			ObjectKey:   objectName,
+			Filename:    filepath.Base(req.Filename),
+			ContentType: contentType,
+			Status:      "pending",
+			ExpiresAt:   time.Now().Add(uploadURLTTL),
+		}
+		if err := db.Create(upload).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"upload_id":  upload.ID,
+			"url":        target.URL,
+			"method":     target.Method,
+			"fields":     target.Fields,
+			"headers":    target.Headers,
+			"expires_at": upload.ExpiresAt,
+			"max_size":   maxDirectUploadSize,
+		})
+	}
+}
+
+// CompleteUpload validates an uploaded object and creates its
+// ProcessingJob with the requested models
+func CompleteUpload(db *gorm.DB, store storage.ObjectStore, reg *registry.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userID")
+
+		var req CompleteUploadRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		var upload models.Upload
+		if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&upload).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
+		}
+
+		switch upload.Status {
+		case "completed":
+			c.JSON(http.StatusConflict, gin.H{"error": "Upload was already completed", "job_id": upload.JobID})
+			return
+		case "failed":
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Upload failed: %s", upload.ErrorMessage)})
+			return
+		}
+
+		// Select models, the default backend is used when none is given
+		selections, err := resolveModels(reg, req.Models, req.ModelVersion)
+		if err != nil {
+			if errors.Is(err, registry.ErrModelNotFound) || errors.Is(err, errTooManyModels) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load model"})
+			return
+		}
+		defer releaseSelections(selections)
+
+		// Claim the upload so concurrent requests cannot create two jobs
+		claim := db.Model(&upload).Where("status = ?", "pending").Update("status", "completing")
+		if claim.Error != nil || claim.RowsAffected == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Upload is already being completed"})
+			return
+		}
+
+		ctx := context.Background()
+
+		// A resumable upload is complete once all bytes arrived and its
+		// parts were joined
+		if upload.Size > 0 {
+			if upload.Offset < upload.Size {
+				db.Model(&upload).Update("status", "pending")
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Upload is incomplete: received %d of %d bytes", upload.Offset, upload.Size)})
+				return
+			}
+			if _, err := store.Stat(ctx, upload.ObjectKey); errors.Is(err, storage.ErrObjectNotFound) {
+				if err := assembleParts(ctx, store, &upload); err != nil {
+					fmt.Printf("error: %v", err)
+					db.Model(&upload).Update("status", "pending")
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assemble upload"})
+					return
+				}
+			}
+		}
+
+		info, err := store.Stat(ctx, upload.ObjectKey)
+		if err != nil {
+			// Let the client retry once the file is uploaded
+			db.Model(&upload).Update("status", "pending")
+			if errors.Is(err, storage.ErrObjectNotFound) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "File has not been uploaded"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check upload"})
+			return
+		}
+
+		maxSize := int64(maxDirectUploadSize)
+		if upload.Size > 0 {
+			maxSize = maxResumableUploadSize
+		}
+		if info.Size == 0 || info.Size > maxSize {
+			failUpload(db, store, &upload, fmt.Sprintf("File size must be between 1 byte and %d bytes", maxSize))
+			c.JSON(http.StatusBadRequest, gin.H{"error": upload.ErrorMessage})
+			return
+		}
+
+		// Parts of a resumable upload were counted as they arrived
+		if upload.Size == 0 {
+			if err := artifacts.CheckQuota(db, userID, info.Size); err != nil {
+				if errors.Is(err, artifacts.ErrQuotaExceeded) {
+					failUpload(db, store, &upload, "Storage quota exceeded")
+					quotaExceeded(c, db, userID)
+					return
+				}
+				db.Model(&upload).Update("status", "pending")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+				return
+			}
+		}
+
+		// Download and validate the uploaded content
+		tempPath := filepath.Join("/tmp", filepath.Base(upload.ObjectKey))
+		if err := store.DownloadFile(ctx, upload.ObjectKey, tempPath); err != nil {
+			db.Model(&upload).Update("status", "pending")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to download upload"})
+			return
+		}
+		defer os.Remove(tempPath)
+
+		if err := imaging.ValidateImageFile(tempPath); err != nil {
+			failUpload(db, store, &upload, fmt.Sprintf("Invalid image: %s", err.Error()))
+			c.JSON(http.StatusBadRequest, gin.H{"error": upload.ErrorMessage})
+			return
+		}
+
+		meta, err := imaging.ExtractMetadata(tempPath)
+		if err != nil {
+			failUpload(db, store, &upload, fmt.Sprintf("Failed to read image metadata: %s", err.Error()))
+			c.JSON(http.StatusBadRequest, gin.H{"error": upload.ErrorMessage})
+			return
+		}
+
+		// startJob deletes the staged object when it fails, so the upload
+		// cannot be completed again
+		job, err := startJob(db, store, userID, upload.ObjectKey, meta, selections)
+		if err != nil {
+			failUpload(db, store, &upload, err.Error())
+			status := http.StatusInternalServerError
+			if errors.Is(err, errOriginalChanged) {
+				status = http.StatusBadRequest
+			}
+			c.JSON(status, gin.H{"error": upload.ErrorMessage})
+			return
+		}
+
+		upload.Status = "completed"
+		upload.ObjectKey = job.OriginalImageURL
+		upload.JobID = &job.ID
+		db.Save(&upload)
+
+		response := jobStartedResponse(job, selections)
+		response["upload_id"] = upload.ID
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// failUpload rejects an upload and removes its object from storage
+func failUpload(db *gorm.DB, store storage.ObjectStore, upload *models.Upload, message string) {
+	store.DeleteFile(context.Background(), upload.ObjectKey)
+
+	upload.Status = "failed"
+	upload.ErrorMessage = message
+	db.Save(upload)
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"diploma-back/internal/artifacts"
+	"diploma-back/internal/models"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type QuotaRequest struct {
+	QuotaBytes *int64 `json:"quota_bytes"`
+}
+
+// GetUsage returns the number and size of the user's stored objects by
+// artifact type, and the user's quota
+func GetUsage(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userID")
+
+		usage, err := artifacts.Usage(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage"})
+			return
+		}
+		quota, err := artifacts.Quota(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch quota"})
+			return
+		}
+
+		var totalCount, totalBytes int64
+		for _, typeUsage := range usage {
+			totalCount += typeUsage.Count
+			totalBytes += typeUsage.Bytes
+		}
+
+		response := gin.H{
+			"total_count": totalCount,
+			"total_bytes": totalBytes,
+			"by_type":     usage,
+			"quota_bytes": nil,
+		}
+		if quota > 0 {
+			response["quota_bytes"] = quota
+			response["remaining_bytes"] = max(quota-totalBytes, 0)
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// SetUserQuota sets a user's storage quota in bytes, 0 is unlimited and
+// null restores the STORAGE_QUOTA_BYTES default
+func SetUserQuota(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user models.User
+		if err := db.First(&user, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		var req QuotaRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.QuotaBytes != nil && *req.QuotaBytes < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "quota_bytes must not be negative"})
+			return
+		}
+
+		if err := db.Model(&user).Update("storage_quota", req.QuotaBytes).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota"})
+			return
+		}
+		user.StorageQuota = req.QuotaBytes
+
+		c.JSON(http.StatusOK, user)
+	}
+}
+
+// checkQuota writes the error response and returns false when size more
+// bytes do not fit the user's storage quota
+func checkQuota(c *gin.Context, db *gorm.DB, userID uint, size int64) bool {
+	err := artifacts.CheckQuota(db, userID, size)
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, artifacts.ErrQuotaExceeded) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+		return false
+	}
+
+	quotaExceeded(c, db, userID)
+	return false
+}
+
+// quotaExceeded writes the error response of an upload over the user's
+// storage quota
+func quotaExceeded(c *gin.Context, db *gorm.DB, userID uint) {
+	quota, _ := artifacts.Quota(db, userID)
+	used, _ := artifacts.UsedBytes(db, userID)
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+		"error":       fmt.Sprintf("Storage quota exceeded: %d of %d bytes used", used, quota),
+		"used_bytes":  used,
+		"quota_bytes": quota,
+	})
+}
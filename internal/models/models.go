@@ -8,13 +8,15 @@ import (
 )
 
 type User struct {
-	ID        uint           `gorm:"primarykey" json:"id"`
-	Email     string         `gorm:"unique;not null" json:"email"`
-	Password  string         `gorm:"not null" json:"-"`
-	Name      string         `json:"name"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID           uint           `gorm:"primarykey" json:"id"`
+	Email        string         `gorm:"unique;not null" json:"email"`
+	Password     string         `gorm:"not null" json:"-"`
+	Name         string         `json:"name"`
+	IsAdmin      bool           `gorm:"default:false" json:"is_admin"`
+	StorageQuota *int64         `json:"storage_quota,omitempty"` // bytes, overrides STORAGE_QUOTA_BYTES, 0 is unlimited
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
 
 	ProcessingJobs []ProcessingJob `gorm:"foreignKey:UserID" json:"processing_jobs,omitempty"`
 }
@@ -26,11 +28,110 @@ type ProcessingJob struct {
 	OutputNiiPath    string         `json:"output_nii_path"`
 	OriginalImageURL string         `json:"original_image_url" gorm:"original_image_url"`
 	ResultImageURL   string         `json:"result_image_url" gorm:"result_image_url"`
-	Status           string         `gorm:"default:'pending'" json:"status"` // pending, processing, completed, failed
+	Status           string         `gorm:"default:'pending'" json:"status"` // pending, processing, completed, failed, expired
+	ModelID          *uint          `gorm:"index" json:"model_id,omitempty"`
+	ModelName        string         `json:"model_name"`
+	ModelVersion     string         `json:"model_version"`
 	ErrorMessage     string         `json:"error_message,omitempty"`
 	CreatedAt        time.Time      `json:"created_at"`
 	UpdatedAt        time.Time      `json:"updated_at"`
 	DeletedAt        gorm.DeletedAt `gorm:"index" json:"-"`
 
-	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	User     User               `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Metadata *ImageMetadata     `gorm:"foreignKey:JobID" json:"metadata,omitempty"`
+	Results  []ProcessingResult `gorm:"foreignKey:JobID" json:"results,omitempty"`
+}
+
+// ProcessingResult is the output of one model for a job
+type ProcessingResult struct {
+	ID             uint      `gorm:"primarykey" json:"id"`
+	JobID          uint      `gorm:"index;not null" json:"job_id"`
+	ModelID        *uint     `gorm:"index" json:"model_id,omitempty"`
+	ModelName      string    `json:"model_name"`
+	ModelVersion   string    `json:"model_version"`
+	OutputNiiPath  string    `json:"output_nii_path"`
+	ResultImageURL string    `json:"result_image_url"`
+	Status         string    `gorm:"default:'pending'" json:"status"` // pending, processing, delivering, completed, failed, expired
+	ErrorMessage   string    `json:"error_message,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+type ImageMetadata struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	JobID       uint      `gorm:"uniqueIndex;not null" json:"job_id"`
+	Format      string    `json:"format"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Depth       int       `json:"depth"`
+	BitDepth    int       `json:"bit_depth"`
+	ColorMode   string    `json:"color_mode"`
+	FileSize    int64     `json:"file_size"`
+	SHA256      string    `gorm:"column:sha256;index" json:"sha256"`
+	Spacing     string    `json:"spacing,omitempty"` // comma separated, in mm
+	Orientation string    `json:"orientation,omitempty"`
+	Modality    string    `json:"modality,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Original is an original image stored once per user under a key derived
+// from its SHA-256, shared by every job that uploaded the same content
+type Original struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_original_user_sha256" json:"user_id"`
+	SHA256    string    `gorm:"column:sha256;not null;uniqueIndex:idx_original_user_sha256" json:"sha256"`
+	ObjectKey string    `gorm:"not null;uniqueIndex" json:"object_key"`
+	Size      int64     `json:"size"`
+	RefCount  int       `gorm:"not null;default:0" json:"ref_count"` // jobs referencing the object
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// StoredObject is an object stored under a user's prefix, recorded for
+// usage accounting and quotas
+type StoredObject struct {
+	ID           uint      `gorm:"primarykey" json:"id"`
+	UserID       uint      `gorm:"index;not null" json:"user_id"`
+	Key          string    `gorm:"uniqueIndex;not null" json:"key"`
+	ArtifactType string    `gorm:"index" json:"artifact_type"`
+	Size         int64     `json:"size"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Model is a registered inference model version
+type Model struct {
+	ID         uint           `gorm:"primarykey" json:"id"`
+	Name       string         `gorm:"not null;uniqueIndex:idx_model_name_version" json:"name"`
+	Version    string         `gorm:"not null;uniqueIndex:idx_model_name_version" json:"version"`
+	Backend    string         `gorm:"not null;default:'http'" json:"backend"` // http, kserve, grpc, stub
+	Endpoint   string         `json:"endpoint"`
+	InputSpec  JSON           `gorm:"type:jsonb" json:"input_spec,omitempty"`
+	OutputSpec JSON           `gorm:"type:jsonb" json:"output_spec,omitempty"`
+	LabelMap   JSON           `gorm:"type:jsonb" json:"label_map,omitempty"`
+	Enabled    bool           `gorm:"default:true" json:"enabled"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// Upload is an original image uploaded straight to object storage through a
+// presigned URL, or in chunks as a resumable upload. Completing it creates
+// the ProcessingJob.
+type Upload struct {
+	ID           uint      `gorm:"primarykey" json:"id"`
+	UserID       uint      `gorm:"index;not null" json:"user_id"`
+	ObjectKey    string    `gorm:"not null" json:"object_key"`
+	Filename     string    `json:"filename"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size,omitempty"`                               // total size of a resumable upload
+	Offset       int64     `gorm:"column:upload_offset" json:"offset,omitempty"` // bytes received of a resumable upload
+	Parts        string    `gorm:"type:text;not null;default:''" json:"-"`       // newline separated part keys of a resumable upload, in offset order
+	Status       string    `gorm:"default:'pending'" json:"status"`              // pending, completing, completed, failed
+	JobID        *uint     `gorm:"index" json:"job_id,omitempty"`
+	ErrorMessage string    `json:"error_message,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	StateClosed   = "closed"    // healthy, jobs run
+	StateOpen     = "open"      // unhealthy, jobs wait
+	StateHalfOpen = "half_open" // cooldown elapsed, one trial job may run
+)
+
+// Breaker tracks the health of one model backend. It opens after a number
+// of consecutive failures from health probes or inference calls, and jobs
+// for the model wait instead of failing one by one after a long timeout.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	trial     bool // a half-open trial call is in flight
+	lastError string
+	lastCheck time.Time
+	closed    chan struct{} // closed when the breaker closes again
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     StateClosed,
+		closed:    make(chan struct{}),
+	}
+}
+
+// Allow reports whether a call may run now. After the cooldown a single
+// trial call is let through to find out whether the backend recovered.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.allowLocked()
+}
+
+func (b *Breaker) allowLocked() bool {
+	switch b.state {
+	case StateClosed:
+		return true
+	case StateOpen:
+		if time.Since(b.openedAt) >= b.cooldown {
+			b.state = StateHalfOpen
+		} else {
+			return false
+		}
+	}
+
+	if b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// Wait blocks until a call is allowed or the context is done
+func (b *Breaker) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		if b.allowLocked() {
+			b.mu.Unlock()
+			return nil
+		}
+		closed := b.closed
+		retry := b.cooldown - time.Since(b.openedAt)
+		b.mu.Unlock()
+
+		if retry <= 0 {
+			// Half-open with a trial in flight, poll until it finishes
+			retry = time.Second
+		}
+		timer := time.NewTimer(retry)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-closed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Abandon gives back a call allowed without recording its outcome, for
+// calls that never reached the backend, so a half-open breaker lets
+// another trial through
+func (b *Breaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateHalfOpen {
+		b.trial = false
+	}
+}
+
+// RecordSuccess closes the breaker
+func (b *Breaker) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+	b.lastError = ""
+	b.lastCheck = time.Now()
+	if b.state != StateClosed {
+		b.state = StateClosed
+		close(b.closed)
+		b.closed = make(chan struct{})
+	}
+}
+
+// RecordFailure counts a failure and opens the breaker at the threshold.
+// A failed half-open trial reopens it immediately.
+func (b *Breaker) RecordFailure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.lastError = err.Error()
+	b.lastCheck = time.Now()
+	if b.state == StateHalfOpen || b.failures >= b.threshold {
+		b.state = StateOpen
+		b.openedAt = time.Now()
+		b.trial = false
+	}
+}
+
+// BreakerStatus is a snapshot of a breaker
+type BreakerStatus struct {
+	State     string
+	Failures  int
+	LastError string
+	LastCheck time.Time
+}
+
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return BreakerStatus{
+		State:     b.state,
+		Failures:  b.failures,
+		LastError: b.lastError,
+		LastCheck: b.lastCheck,
+	}
+}
@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"context"
+	"diploma-back/internal/models"
+	"diploma-back/pkg/imaging"
+	"log"
+	"sort"
+	"time"
+)
+
+// ModelStatus is the health of one model backend
+type ModelStatus struct {
+	ModelID *uint
+	Name    string
+	Version string
+	Backend string
+	BreakerStatus
+}
+
+// StartHealthChecks probes the default backend and every enabled model
+// every MODEL_HEALTH_INTERVAL (default 30s) until the context is done.
+// Backends without a health check are only judged by their calls.
+func (r *Registry) StartHealthChecks(ctx context.Context) {
+	interval := envDuration("MODEL_HEALTH_INTERVAL", 30*time.Second)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			r.probeAll(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (r *Registry) probeAll(ctx context.Context) {
+	r.probe(ctx, 0, r.defaultBackend)
+
+	var enabled []models.Model
+	if err := r.db.Where("enabled = ?", true).Find(&enabled).Error; err != nil {
+		log.Printf("health check: failed to list models: %v", err)
+		return
+	}
+
+	for i := range enabled {
+		model := &enabled[i]
+		entry, err := r.acquire(model)
+		if err != nil {
+			r.breakerFor(model.ID).RecordFailure(err)
+			continue
+		}
+		r.probe(ctx, model.ID, entry.backend)
+		r.release(entry)
+	}
+}
+
+func (r *Registry) probe(ctx context.Context, modelID uint, backend imaging.InferenceBackend) {
+	breaker := r.breakerFor(modelID)
+	checker, ok := backend.(imaging.HealthChecker)
+	if !ok {
+		return
+	}
+
+	if err := checker.HealthCheck(ctx); err != nil {
+		if breaker.Status().State == StateClosed {
+			log.Printf("health check: model %d is unhealthy: %v", modelID, err)
+		}
+		breaker.RecordFailure(err)
+		return
+	}
+	breaker.RecordSuccess()
+}
+
+// Statuses returns the health of every known model backend, the default
+// backend first
+func (r *Registry) Statuses() []ModelStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := make([]ModelStatus, 0, len(r.breakers))
+	for id, breaker := range r.breakers {
+		name := r.names[id]
+		status := ModelStatus{
+			Name:          name.name,
+			Version:       name.version,
+			Backend:       name.backend,
+			BreakerStatus: breaker.Status(),
+		}
+		if id != 0 {
+			modelID := id
+			status.ModelID = &modelID
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].ModelID == nil || statuses[j].ModelID == nil {
+			return statuses[i].ModelID == nil
+		}
+		return *statuses[i].ModelID < *statuses[j].ModelID
+	})
+	return statuses
+}
@@ -0,0 +1,313 @@
+package registry
+
+import (
+	"diploma-back/internal/models"
+	"diploma-back/pkg/imaging"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrModelNotFound is returned when no enabled model matches a request
+var ErrModelNotFound = errors.New("model not found or disabled")
+
+// Selection is the model chosen for a job and the backend that runs it
+type Selection struct {
+	ModelID    *uint
+	Name       string
+	Version    string
+	Model      *models.Model // nil for the default backend
+	Backend    imaging.InferenceBackend
+	OutputSpec *imaging.OutputSpec
+	Breaker    *Breaker
+
+	registry *Registry
+	entry    *backendEntry // nil for the default backend
+	released sync.Once
+}
+
+// Release gives up the selection's use of its backend. A backend dropped
+// by Invalidate is closed once no selection uses it.
+func (s *Selection) Release() {
+	s.released.Do(func() {
+		if s.entry != nil {
+			s.registry.release(s.entry)
+		}
+	})
+}
+
+// Hold keeps the selection's backend open for work that outlives the
+// selection, until the returned function is called
+func (s *Selection) Hold() func() {
+	if s.entry == nil {
+		return func() {}
+	}
+	s.registry.mu.Lock()
+	s.entry.refs++
+	s.registry.mu.Unlock()
+
+	var once sync.Once
+	return func() { once.Do(func() { s.registry.release(s.entry) }) }
+}
+
+// InputSpec holds the backend options stored in a model's input spec
+type InputSpec struct {
+	InputName  string `json:"input_name"`
+	OutputName string `json:"output_name"`
+	BinaryData bool   `json:"binary_data"`
+	TLS        bool   `json:"tls"`
+	BatchSize  int    `json:"batch_size"`
+	BatchWait  int    `json:"batch_wait_ms"`
+}
+
+// Registry resolves registered models to inference backends, caching one
+// backend per model row. Selections count as users of their backend, so a
+// backend replaced after a model update is only closed once its jobs are
+// done with it.
+type Registry struct {
+	db             *gorm.DB
+	defaultBackend imaging.InferenceBackend
+	defaultName    string
+	defaultVersion string
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	mu       sync.Mutex
+	backends map[uint]*backendEntry
+	breakers map[uint]*Breaker // keyed by model ID, 0 is the default backend
+	names    map[uint]modelName
+}
+
+// backendEntry is a cached backend and the number of its users
+type backendEntry struct {
+	backend imaging.InferenceBackend
+	refs    int
+	retired bool // dropped from the cache, closed when refs reaches zero
+}
+
+type modelName struct {
+	name    string
+	version string
+	backend string
+}
+
+// New creates a registry. The default backend is used for jobs that do not
+// name a model and is recorded as MODEL_NAME / MODEL_VERSION. A model's
+// circuit breaker opens after MODEL_BREAKER_THRESHOLD consecutive failures
+// (default 3) and retries after MODEL_BREAKER_COOLDOWN (default 30s).
+func New(db *gorm.DB, defaultBackend imaging.InferenceBackend) *Registry {
+	name := os.Getenv("MODEL_NAME")
+	if name == "" {
+		name = "default"
+	}
+
+	threshold := 3
+	if value, err := strconv.Atoi(os.Getenv("MODEL_BREAKER_THRESHOLD")); err == nil && value > 0 {
+		threshold = value
+	}
+
+	r := &Registry{
+		db:               db,
+		defaultBackend:   defaultBackend,
+		defaultName:      name,
+		defaultVersion:   os.Getenv("MODEL_VERSION"),
+		breakerThreshold: threshold,
+		breakerCooldown:  envDuration("MODEL_BREAKER_COOLDOWN", 30*time.Second),
+		backends:         map[uint]*backendEntry{},
+		breakers:         map[uint]*Breaker{},
+		names:            map[uint]modelName{},
+	}
+	r.names[0] = modelName{name: r.defaultName, version: r.defaultVersion, backend: defaultBackend.Name()}
+	return r
+}
+
+// envDuration reads a duration from the environment, falling back to the
+// default when unset or invalid
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// breakerFor returns the circuit breaker of a model, 0 being the default
+// backend
+func (r *Registry) breakerFor(modelID uint) *Breaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	breaker, ok := r.breakers[modelID]
+	if !ok {
+		breaker = NewBreaker(r.breakerThreshold, r.breakerCooldown)
+		r.breakers[modelID] = breaker
+	}
+	return breaker
+}
+
+// Resolve returns the enabled model with the given name and version. An
+// empty version selects the most recently registered enabled version, and
+// an empty name selects the default backend.
+func (r *Registry) Resolve(name string, version string) (*Selection, error) {
+	if name == "" {
+		return &Selection{
+			Name:    r.defaultName,
+			Version: r.defaultVersion,
+			Backend: r.defaultBackend,
+			Breaker: r.breakerFor(0),
+		}, nil
+	}
+
+	query := r.db.Where("name = ? AND enabled = ?", name, true)
+	if version != "" {
+		query = query.Where("version = ?", version)
+	}
+
+	var model models.Model
+	if err := query.Order("created_at DESC").First(&model).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrModelNotFound
+		}
+		return nil, err
+	}
+
+	spec, err := OutputSpecFor(&model)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := r.acquire(&model)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Selection{
+		ModelID:    &model.ID,
+		Name:       model.Name,
+		Version:    model.Version,
+		Model:      &model,
+		Backend:    entry.backend,
+		OutputSpec: spec,
+		Breaker:    r.breakerFor(model.ID),
+		registry:   r,
+		entry:      entry,
+	}, nil
+}
+
+// OutputSpecFor returns the declared output spec of a model. When no
+// labels are declared, the keys of the label map are the allowed labels.
+// Background 0 is always allowed, label maps rarely list it.
+func OutputSpecFor(model *models.Model) (*imaging.OutputSpec, error) {
+	var spec imaging.OutputSpec
+	if len(model.OutputSpec) > 0 {
+		if err := json.Unmarshal(model.OutputSpec, &spec); err != nil {
+			return nil, fmt.Errorf("invalid output spec for model %s:%s: %w", model.Name, model.Version, err)
+		}
+	}
+
+	if len(spec.Labels) == 0 && len(model.LabelMap) > 0 {
+		var labelMap map[string]string
+		if err := json.Unmarshal(model.LabelMap, &labelMap); err != nil {
+			return nil, fmt.Errorf("invalid label map for model %s:%s: %w", model.Name, model.Version, err)
+		}
+		for key := range labelMap {
+			label, err := strconv.Atoi(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid label %q for model %s:%s", key, model.Name, model.Version)
+			}
+			spec.Labels = append(spec.Labels, label)
+		}
+	}
+
+	if len(spec.Labels) > 0 && !slices.Contains(spec.Labels, 0) {
+		spec.Labels = append(spec.Labels, 0)
+	}
+	sort.Ints(spec.Labels)
+
+	return &spec, nil
+}
+
+// acquire returns the cached backend of a model, creating it when needed,
+// and counts the caller as a user until release
+func (r *Registry) acquire(model *models.Model) (*backendEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.backends[model.ID]; ok {
+		entry.refs++
+		return entry, nil
+	}
+
+	var spec InputSpec
+	if len(model.InputSpec) > 0 {
+		if err := json.Unmarshal(model.InputSpec, &spec); err != nil {
+			return nil, fmt.Errorf("invalid input spec for model %s:%s: %w", model.Name, model.Version, err)
+		}
+	}
+
+	backend, err := imaging.NewInferenceBackendFromConfig(imaging.BackendConfig{
+		Kind:       model.Backend,
+		Endpoint:   model.Endpoint,
+		Model:      model.Name,
+		Version:    model.Version,
+		InputName:  spec.InputName,
+		OutputName: spec.OutputName,
+		BinaryData: spec.BinaryData,
+		TLS:        spec.TLS,
+		BatchSize:  spec.BatchSize,
+		BatchWait:  time.Duration(spec.BatchWait) * time.Millisecond,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backend for model %s:%s: %w", model.Name, model.Version, err)
+	}
+
+	entry := &backendEntry{backend: backend, refs: 1}
+	r.backends[model.ID] = entry
+	r.names[model.ID] = modelName{name: model.Name, version: model.Version, backend: backend.Name()}
+	return entry, nil
+}
+
+// release ends a use of a backend, closing a retired backend after its
+// last use
+func (r *Registry) release(entry *backendEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry.refs--
+	if entry.retired && entry.refs == 0 {
+		closeBackend(entry.backend)
+	}
+}
+
+func closeBackend(backend imaging.InferenceBackend) {
+	if closer, ok := backend.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// Invalidate drops the cached backend of a model after it was changed. The
+// backend is closed once running jobs no longer use it.
+func (r *Registry) Invalidate(modelID uint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.backends[modelID]; ok {
+		entry.retired = true
+		if entry.refs == 0 {
+			closeBackend(entry.backend)
+		}
+		delete(r.backends, modelID)
+	}
+	// The model may point at a different server now
+	delete(r.breakers, modelID)
+	delete(r.names, modelID)
+}
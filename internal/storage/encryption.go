@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// ErrPresignUnsupported is returned for presigned download URLs of objects
+// encrypted with customer keys, which only the API can send
+var ErrPresignUnsupported = errors.New("presigned URLs are not supported with SSE-C")
+
+const (
+	sseNone = ""
+	sseS3   = "sse-s3"
+	sseC    = "sse-c"
+)
+
+// Encryption is the server-side encryption of stored objects, selected by
+// STORAGE_SSE: empty for none, "sse-s3" for keys managed by the object
+// store, or "sse-c" for customer keys. SSE-C keys are derived per tenant
+// (the users/<id>/ prefix of a key) from master keys listed in
+// STORAGE_SSE_KEYS as "id:base64key,..." with 32 byte keys. New objects use
+// STORAGE_SSE_KEY_ID (default the last listed key), older keys stay usable
+// for reading until objects are rotated to the current key.
+type Encryption struct {
+	mode    string
+	keys    map[string][]byte
+	order   []string
+	current string
+}
+
+// LoadEncryption reads the encryption configuration from the environment
+func LoadEncryption() (*Encryption, error) {
+	e := &Encryption{mode: strings.ToLower(os.Getenv("STORAGE_SSE")), keys: map[string][]byte{}}
+
+	switch e.mode {
+	case sseNone, sseS3:
+		return e, nil
+	case sseC:
+	default:
+		return nil, fmt.Errorf("unknown server-side encryption: %s", e.mode)
+	}
+
+	for _, entry := range strings.Split(os.Getenv("STORAGE_SSE_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid STORAGE_SSE_KEYS entry, expected id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("SSE-C key %q must be 32 bytes, base64 encoded", id)
+		}
+		if _, exists := e.keys[id]; exists {
+			return nil, fmt.Errorf("duplicate SSE-C key id %q", id)
+		}
+		e.keys[id] = key
+		e.order = append(e.order, id)
+	}
+	if len(e.order) == 0 {
+		return nil, fmt.Errorf("STORAGE_SSE_KEYS is required for SSE-C")
+	}
+
+	e.current = os.Getenv("STORAGE_SSE_KEY_ID")
+	if e.current == "" {
+		e.current = e.order[len(e.order)-1]
+	}
+	if _, ok := e.keys[e.current]; !ok {
+		return nil, fmt.Errorf("STORAGE_SSE_KEY_ID %q is not in STORAGE_SSE_KEYS", e.current)
+	}
+
+	return e, nil
+}
+
+// Enabled reports whether objects are encrypted
+func (e *Encryption) Enabled() bool {
+	return e.mode != sseNone
+}
+
+// CustomerKeys reports whether objects are encrypted with SSE-C
+func (e *Encryption) CustomerKeys() bool {
+	return e.mode == sseC
+}
+
+// forWrite returns the encryption of a new object
+func (e *Encryption) forWrite(objectName string) encrypt.ServerSide {
+	switch e.mode {
+	case sseS3:
+		return encrypt.NewSSE()
+	case sseC:
+		return e.tenantKey(e.current, objectName)
+	}
+	return nil
+}
+
+// forRead returns the encryptions an object may have been written with,
+// the current one first. Objects stored before encryption was enabled are
+// read without a key.
+func (e *Encryption) forRead(objectName string) []encrypt.ServerSide {
+	if e.mode != sseC {
+		// SSE-S3 objects are decrypted by the store without a key
+		return []encrypt.ServerSide{nil}
+	}
+
+	candidates := []encrypt.ServerSide{e.tenantKey(e.current, objectName)}
+	for i := len(e.order) - 1; i >= 0; i-- {
+		if id := e.order[i]; id != e.current {
+			candidates = append(candidates, e.tenantKey(id, objectName))
+		}
+	}
+	return append(candidates, nil)
+}
+
+// tenantKey derives the SSE-C key of an object's tenant from a master key,
+// so every tenant's objects are encrypted with a key of their own
+func (e *Encryption) tenantKey(id string, objectName string) encrypt.ServerSide {
+	mac := hmac.New(sha256.New, e.keys[id])
+	mac.Write([]byte(tenantOf(objectName)))
+
+	// NewSSEC only fails for keys that are not 32 bytes
+	sse, _ := encrypt.NewSSEC(mac.Sum(nil))
+	return sse
+}
+
+// tenantOf returns the users/<id> prefix of a key, or "shared" for keys
+// outside a user's prefix
+func tenantOf(objectName string) string {
+	parts := strings.SplitN(objectName, "/", 3)
+	if len(parts) == 3 && parts[0] == "users" {
+		return parts[0] + "/" + parts[1]
+	}
+	return "shared"
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+)
+
+// ErrChecksumMismatch is returned when an object read back does not match
+// the SHA-256 it was stored with
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumMetaKey is the object metadata holding the hex SHA-256 of the
+// content, set on every object the API writes
+const checksumMetaKey = "sha256"
+
+// compositeHash computes the SHA-256 of the SHA-256s of consecutive parts
+// of partSize bytes, the checksum S3 stores for multipart uploads
+type compositeHash struct {
+	partSize int64
+	part     hash.Hash
+	partRead int64
+	sums     []byte
+}
+
+// newChecksumHash returns the hash of a checksum over the whole content,
+// or over parts of partSize when it is not 0
+func newChecksumHash(partSize int64) hash.Hash {
+	if partSize == 0 {
+		return sha256.New()
+	}
+	return &compositeHash{partSize: partSize, part: sha256.New()}
+}
+
+func (h *compositeHash) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := min(int64(len(p)), h.partSize-h.partRead)
+		h.part.Write(p[:n])
+		h.partRead += n
+		p = p[n:]
+		if h.partRead == h.partSize {
+			h.sums = h.part.Sum(h.sums)
+			h.part.Reset()
+			h.partRead = 0
+		}
+	}
+	return written, nil
+}
+
+func (h *compositeHash) Sum(b []byte) []byte {
+	sums := h.sums
+	// The last part is shorter, an empty object is one empty part
+	if h.partRead > 0 || len(sums) == 0 {
+		sums = h.part.Sum(append([]byte(nil), sums...))
+	}
+	sum := sha256.Sum256(sums)
+	return append(b, sum[:]...)
+}
+
+func (h *compositeHash) Reset() {
+	h.part.Reset()
+	h.partRead = 0
+	h.sums = nil
+}
+
+func (h *compositeHash) Size() int      { return sha256.Size }
+func (h *compositeHash) BlockSize() int { return sha256.BlockSize }
+
+// verifyingReader hashes an object while it is read and fails the read of
+// its last bytes when the content does not match the stored checksum, so
+// a client given the size never receives a complete corrupt object
+type verifyingReader struct {
+	io.ReadCloser
+	objectName string
+	expected   string
+	size       int64
+	read       int64
+	hash       hash.Hash
+	err        error
+}
+
+// newVerifyingReader wraps an object reader, objects stored without a
+// checksum are returned as is. A partSize other than 0 selects a composite
+// checksum.
+func newVerifyingReader(object io.ReadCloser, objectName string, expected string, partSize int64, size int64) io.ReadCloser {
+	if expected == "" {
+		return object
+	}
+	return &verifyingReader{
+		ReadCloser: object,
+		objectName: objectName,
+		expected:   expected,
+		size:       size,
+		hash:       newChecksumHash(partSize),
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	r.read += int64(n)
+
+	if err == io.EOF || (r.size >= 0 && r.read >= r.size) {
+		if actual := hex.EncodeToString(r.hash.Sum(nil)); actual != r.expected {
+			r.err = checksumError(r.objectName, r.expected, actual)
+			return 0, r.err
+		}
+	}
+	return n, err
+}
+
+// checksumError logs a corrupt object and returns ErrChecksumMismatch
+func checksumError(objectName string, expected string, actual string) error {
+	log.Printf("integrity: object %s has SHA-256 %s, stored with %s", objectName, actual, expected)
+	return fmt.Errorf("%w: %s", ErrChecksumMismatch, objectName)
+}
+
+// fileSHA256 returns the hex SHA-256 of a file
+func fileSHA256(filePath string) (string, error) {
+	return fileChecksum(filePath, 0)
+}
+
+// fileChecksum returns the hex checksum of a file, composite when partSize
+// is not 0
+func fileChecksum(filePath string, partSize int64) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := newChecksumHash(partSize)
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifyFile checks a downloaded object against its stored checksum and
+// removes the file when it does not match
+func verifyFile(filePath string, objectName string, expected string, partSize int64) error {
+	if expected == "" {
+		return nil
+	}
+	actual, err := fileChecksum(filePath, partSize)
+	if err != nil {
+		return fmt.Errorf("failed to verify object: %w", err)
+	}
+	if actual != expected {
+		os.Remove(filePath)
+		return checksumError(objectName, expected, actual)
+	}
+	return nil
+}
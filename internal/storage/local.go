@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// localMetaDir holds the metadata of each object, mirroring the key layout
+const localMetaDir = ".meta"
+
+// LocalStore keeps objects on the local disk, for running the server and
+// tests without MinIO. Presigned URLs point at the files route of this
+// server and are signed with LOCAL_STORAGE_SECRET.
+type LocalStore struct {
+	root       string
+	baseURL    string
+	secret     []byte
+	presignTTL time.Duration
+}
+
+type localMeta struct {
+	ContentType string `json:"content_type"`
+	SHA256      string `json:"sha256,omitempty"`
+}
+
+// NewLocalStore stores objects under LOCAL_STORAGE_PATH (default
+// ./uploads) and builds download URLs from LOCAL_STORAGE_URL, the public
+// URL of this server (default http://localhost:8080)
+func NewLocalStore() (*LocalStore, error) {
+	root := os.Getenv("LOCAL_STORAGE_PATH")
+	if root == "" {
+		root = "./uploads"
+	}
+	baseURL := os.Getenv("LOCAL_STORAGE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+
+	secret := []byte(os.Getenv("LOCAL_STORAGE_SECRET"))
+	if len(secret) == 0 {
+		// URLs stop working after a restart, which is fine for development
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate storage secret: %w", err)
+		}
+		log.Println("LOCAL_STORAGE_SECRET not set, using a random secret")
+	}
+
+	presignTTL, err := presignedURLTTL()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	return &LocalStore{
+		root:       root,
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		secret:     secret,
+		presignTTL: presignTTL,
+	}, nil
+}
+
+// objectPath maps a key to a file path, rejecting keys that would escape
+// the storage root
+func (s *LocalStore) objectPath(objectName string) (string, error) {
+	clean := path.Clean("/" + objectName)[1:]
+	if clean == "" || clean != objectName || clean == localMetaDir || strings.HasPrefix(clean, localMetaDir+"/") {
+		return "", fmt.Errorf("invalid object name: %q", objectName)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+func (s *LocalStore) metaPath(objectName string) string {
+	return filepath.Join(s.root, localMetaDir, filepath.FromSlash(objectName)+".json")
+}
+
+// UploadFile uploads a file to the store
+func (s *LocalStore) UploadFile(ctx context.Context, objectName string, filePath string, contentType string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	return s.UploadFromReader(ctx, objectName, file, -1, contentType)
+}
+
+// UploadFromReader writes the object to a temporary file and renames it
+// into place, so readers never see a partial object
+func (s *LocalStore) UploadFromReader(ctx context.Context, objectName string, reader io.Reader, size int64, contentType string) (string, error) {
+	objectPath, err := s.objectPath(objectName)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create object directory: %w", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(objectPath), ".upload-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create object: %w", err)
+	}
+	defer os.Remove(temp.Name())
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(temp, hash), reader)
+	temp.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to write object: %w", err)
+	}
+	if size >= 0 && written != size {
+		return "", fmt.Errorf("failed to write object: got %d bytes, expected %d", written, size)
+	}
+
+	meta := localMeta{ContentType: contentType, SHA256: hex.EncodeToString(hash.Sum(nil))}
+	if err := s.writeMeta(objectName, meta); err != nil {
+		return "", err
+	}
+	if err := os.Rename(temp.Name(), objectPath); err != nil {
+		return "", fmt.Errorf("failed to write object: %w", err)
+	}
+
+	return objectName, nil
+}
+
+func (s *LocalStore) writeMeta(objectName string, meta localMeta) error {
+	metaPath := s.metaPath(objectName)
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(metaPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write object metadata: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStore) readMeta(objectName string) localMeta {
+	var meta localMeta
+	if data, err := os.ReadFile(s.metaPath(objectName)); err == nil {
+		json.Unmarshal(data, &meta)
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = "application/octet-stream"
+	}
+	return meta
+}
+
+// DownloadFile copies an object to a local file, a file failing the checksum
+// is removed
+func (s *LocalStore) DownloadFile(ctx context.Context, objectName string, destPath string) error {
+	object, err := s.GetObject(ctx, objectName)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	dest, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer dest.Close()
+
+	if _, err := io.Copy(dest, object); err != nil {
+		dest.Close()
+		os.Remove(destPath)
+		return fmt.Errorf("failed to download object: %w", err)
+	}
+	return nil
+}
+
+// GetObject returns an object reader that verifies the checksum of the
+// object as it is read
+func (s *LocalStore) GetObject(ctx context.Context, objectName string) (io.ReadCloser, error) {
+	objectPath, err := s.objectPath(objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(objectPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	return newVerifyingReader(file, objectName, s.readMeta(objectName).SHA256, 0, info.Size()), nil
+}
+
+// DeleteFile deletes an object, deleting a missing object is not an error
+func (s *LocalStore) DeleteFile(ctx context.Context, objectName string) error {
+	objectPath, err := s.objectPath(objectName)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(objectPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	os.Remove(s.metaPath(objectName))
+	return nil
+}
+
+// CopyObject copies an object and its content type to another key
+func (s *LocalStore) CopyObject(ctx context.Context, srcName string, destName string) error {
+	src, err := s.GetObject(ctx, srcName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = s.UploadFromReader(ctx, destName, src, -1, s.readMeta(srcName).ContentType)
+	return err
+}
+
+// GetPresignedURL returns a signed download URL valid for
+// PRESIGNED_URL_TTL
+func (s *LocalStore) GetPresignedURL(ctx context.Context, objectName string) (string, error) {
+	return s.presign(http.MethodGet, objectName, s.presignTTL, "")
+}
+
+// PresignUpload returns a signed URL for uploading with PUT. The size
+// limit is part of the signature and enforced by ReceiveLocalFile.
+func (s *LocalStore) PresignUpload(ctx context.Context, objectName string, contentType string, maxSize int64, expires time.Duration) (*UploadTarget, error) {
+	url, err := s.presign(http.MethodPut, objectName, expires, strconv.FormatInt(maxSize, 10))
+	if err != nil {
+		return nil, err
+	}
+	return &UploadTarget{URL: url, Method: http.MethodPut, Headers: map[string]string{"Content-Type": contentType}}, nil
+}
+
+func (s *LocalStore) presign(method string, objectName string, ttl time.Duration, maxSize string) (string, error) {
+	if _, err := s.objectPath(objectName); err != nil {
+		return "", err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expires)
+	if maxSize != "" {
+		query.Set("max_size", maxSize)
+	}
+	query.Set("signature", s.sign(method, objectName, expires, maxSize))
+
+	return s.baseURL + "/api/files/" + (&url.URL{Path: objectName}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+func (s *LocalStore) sign(method string, objectName string, expires string, maxSize string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(method + "\n" + objectName + "\n" + expires + "\n" + maxSize))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyURL checks the method, expiry, size limit and signature of a
+// presigned URL
+func (s *LocalStore) VerifyURL(method string, objectName string, expires string, maxSize string, signature string) error {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return fmt.Errorf("URL has expired")
+	}
+	if !hmac.Equal([]byte(s.sign(method, objectName, expires, maxSize)), []byte(signature)) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// Stat returns the size and content type of an object
+func (s *LocalStore) Stat(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	objectPath, err := s.objectPath(objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(objectPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	meta := s.readMeta(objectName)
+	return &ObjectInfo{
+		Key:          objectName,
+		Size:         info.Size(),
+		ContentType:  meta.ContentType,
+		LastModified: info.ModTime(),
+		SHA256:       meta.SHA256,
+	}, nil
+}
+
+// List returns all objects whose key starts with prefix
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(s.root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			if key == localMetaDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			ContentType:  s.readMeta(key).ContentType,
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
@@ -3,19 +3,36 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/sse"
 )
 
+// streamPartSize is the multipart part size of uploads of unknown size,
+// which caps them at 10000 parts, about 156 GiB
+const streamPartSize = 16 << 20
+
 type MinIOClient struct {
 	client *minio.Client
-	bucket string
+	// presignClient signs URLs for the endpoint browsers reach the store at
+	presignClient *minio.Client
+	bucket        string
+	encryption    *Encryption
+	presignTTL    time.Duration
 }
 
 func NewMinIOClient() (*MinIOClient, error) {
@@ -32,9 +49,29 @@ func NewMinIOClient() (*MinIOClient, error) {
 		bucket = "medical-imaging"
 	}
 
+	encryption, err := LoadEncryption()
+	if err != nil {
+		return nil, err
+	}
+	// S3 stores only accept customer keys over TLS
+	if encryption.CustomerKeys() && !useSSL {
+		return nil, fmt.Errorf("SSE-C requires MINIO_USE_SSL=true")
+	}
+
+	presignTTL, err := presignedURLTTL()
+	if err != nil {
+		return nil, err
+	}
+	// S3 signatures are valid for at most a week
+	if presignTTL > 7*24*time.Hour {
+		return nil, fmt.Errorf("PRESIGNED_URL_TTL must not exceed 168h")
+	}
+
 	client, err := minio.New(endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
 		Secure: useSSL,
+		// Streamed uploads send their SHA-256 as a trailer
+		TrailingHeaders: true,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create MinIO client: %w", err)
@@ -54,12 +91,59 @@ func NewMinIOClient() (*MinIOClient, error) {
 		}
 	}
 
+	// Encrypt objects uploaded through presigned URLs too
+	if encryption.Enabled() && !encryption.CustomerKeys() {
+		if err := client.SetBucketEncryption(ctx, bucket, sse.NewConfigurationSSES3()); err != nil {
+			log.Printf("failed to enable default bucket encryption: %v", err)
+		}
+	}
+
+	presignClient, err := newPresignClient(ctx, client, bucket, accessKey, secretKey)
+	if err != nil {
+		return nil, err
+	}
+
 	return &MinIOClient{
-		client: client,
-		bucket: bucket,
+		client:        client,
+		presignClient: presignClient,
+		bucket:        bucket,
+		encryption:    encryption,
+		presignTTL:    presignTTL,
 	}, nil
 }
 
+// newPresignClient returns a client for MINIO_PUBLIC_URL, the scheme and
+// host browsers reach the store at when the API uses an internal endpoint.
+// The host is part of the signature, so URLs cannot be rewritten after
+// signing. Signing needs no requests, the region is looked up through the
+// internal endpoint.
+func newPresignClient(ctx context.Context, client *minio.Client, bucket string, accessKey string, secretKey string) (*minio.Client, error) {
+	publicURL := os.Getenv("MINIO_PUBLIC_URL")
+	if publicURL == "" {
+		return client, nil
+	}
+
+	endpoint, err := url.Parse(publicURL)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || strings.Trim(endpoint.Path, "/") != "" {
+		return nil, fmt.Errorf("MINIO_PUBLIC_URL must be a scheme and host such as https://files.example.com")
+	}
+
+	region, err := client.GetBucketLocation(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bucket region: %w", err)
+	}
+
+	presignClient, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: endpoint.Scheme == "https",
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create MinIO client for MINIO_PUBLIC_URL: %w", err)
+	}
+	return presignClient, nil
+}
+
 // UploadFile uploads a file to MinIO
 func (m *MinIOClient) UploadFile(ctx context.Context, objectName string, filePath string, contentType string) (string, error) {
 	file, err := os.Open(filePath)
@@ -73,8 +157,15 @@ func (m *MinIOClient) UploadFile(ctx context.Context, objectName string, filePat
 		return "", fmt.Errorf("failed to stat file: %w", err)
 	}
 
+	checksum, err := fileSHA256(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+
 	_, err = m.client.PutObject(ctx, m.bucket, objectName, file, fileStat.Size(), minio.PutObjectOptions{
-		ContentType: contentType,
+		ContentType:          contentType,
+		UserMetadata:         map[string]string{checksumMetaKey: checksum},
+		ServerSideEncryption: m.encryption.forWrite(objectName),
 	})
 	if err != nil {
 		return "", fmt.Errorf("failed to upload to MinIO: %w", err)
@@ -83,11 +174,31 @@ func (m *MinIOClient) UploadFile(ctx context.Context, objectName string, filePat
 	return objectName, nil
 }
 
-// UploadFromReader uploads from an io.Reader
+// UploadFromReader uploads from an io.Reader. A seekable reader of known
+// size is hashed first and stored with the checksum in its metadata, like
+// UploadFile. Other readers are streamed in parts of streamPartSize with a
+// SHA-256 the store verifies per part and keeps as a composite checksum.
 func (m *MinIOClient) UploadFromReader(ctx context.Context, objectName string, reader io.Reader, size int64, contentType string) (string, error) {
-	_, err := m.client.PutObject(ctx, m.bucket, objectName, reader, size, minio.PutObjectOptions{
-		ContentType: contentType,
-	})
+	opts := minio.PutObjectOptions{
+		ContentType:          contentType,
+		ServerSideEncryption: m.encryption.forWrite(objectName),
+	}
+
+	if seeker, ok := reader.(io.ReadSeeker); ok && size >= 0 {
+		checksum, err := readerSHA256(seeker, size)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash upload: %w", err)
+		}
+		opts.UserMetadata = map[string]string{checksumMetaKey: checksum}
+	} else {
+		opts.Checksum = minio.ChecksumSHA256
+		// Reads recompute the composite checksum from the part size. Without
+		// it minio-go would also buffer parts sized for the largest possible
+		// object, about 512 MiB per upload.
+		opts.PartSize = streamPartSize
+	}
+
+	_, err := m.client.PutObject(ctx, m.bucket, objectName, reader, size, opts)
 	if err != nil {
 		return "", fmt.Errorf("failed to upload to MinIO: %w", err)
 	}
@@ -95,22 +206,119 @@ func (m *MinIOClient) UploadFromReader(ctx context.Context, objectName string, r
 	return objectName, nil
 }
 
-// DownloadFile downloads a file from MinIO
+// readerSHA256 hashes the next size bytes of a reader and seeks back to
+// where they start
+func readerSHA256(reader io.ReadSeeker, size int64) (string, error) {
+	start, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, reader, size); err != nil {
+		return "", err
+	}
+	if _, err := reader.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checksumOf returns the hex checksum of an object and the part size it is
+// computed over, 0 for a SHA-256 of the whole content. Objects the API
+// hashed before writing carry it in their metadata, streamed objects have
+// the checksum the store kept, which is composite for multipart uploads.
+// Objects with neither return "".
+func checksumOf(info minio.ObjectInfo) (string, int64) {
+	if checksum := info.Metadata.Get("X-Amz-Meta-" + checksumMetaKey); checksum != "" {
+		return checksum, 0
+	}
+
+	value, _, composite := strings.Cut(info.ChecksumSHA256, "-")
+	sum, err := base64.StdEncoding.DecodeString(value)
+	if value == "" || err != nil {
+		return "", 0
+	}
+	if composite || info.ChecksumMode == "COMPOSITE" {
+		return hex.EncodeToString(sum), streamPartSize
+	}
+	return hex.EncodeToString(sum), 0
+}
+
+// contentSHA256 returns the hex SHA-256 of an object's whole content if it
+// is known without reading the object
+func contentSHA256(info minio.ObjectInfo) string {
+	if checksum, partSize := checksumOf(info); partSize == 0 {
+		return checksum
+	}
+	return ""
+}
+
+// withReadKey calls read with each encryption the object may have been
+// written with, until one is accepted
+func (m *MinIOClient) withReadKey(objectName string, read func(key encrypt.ServerSide) error) error {
+	var err error
+	for _, key := range m.encryption.forRead(objectName) {
+		err = read(key)
+		if err == nil || minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return err
+		}
+	}
+	return err
+}
+
+// statWithKey returns the object info and the encryption the object was
+// written with
+func (m *MinIOClient) statWithKey(ctx context.Context, objectName string) (minio.ObjectInfo, encrypt.ServerSide, error) {
+	var info minio.ObjectInfo
+	var found encrypt.ServerSide
+	err := m.withReadKey(objectName, func(key encrypt.ServerSide) error {
+		var err error
+		info, err = m.client.StatObject(ctx, m.bucket, objectName, minio.StatObjectOptions{ServerSideEncryption: key, Checksum: true})
+		found = key
+		return err
+	})
+	return info, found, err
+}
+
+// DownloadFile downloads a file from MinIO and verifies its checksum
 func (m *MinIOClient) DownloadFile(ctx context.Context, objectName string, destPath string) error {
-	err := m.client.FGetObject(ctx, m.bucket, objectName, destPath, minio.GetObjectOptions{})
+	info, key, err := m.statWithKey(ctx, objectName)
+	if err == nil {
+		err = m.client.FGetObject(ctx, m.bucket, objectName, destPath, minio.GetObjectOptions{ServerSideEncryption: key})
+	}
 	if err != nil {
 		return fmt.Errorf("failed to download from MinIO: %w", err)
 	}
-	return nil
+	checksum, partSize := checksumOf(info)
+	return verifyFile(destPath, objectName, checksum, partSize)
 }
 
-// GetObject returns an object reader
-func (m *MinIOClient) GetObject(ctx context.Context, objectName string) (*minio.Object, error) {
-	object, err := m.client.GetObject(ctx, m.bucket, objectName, minio.GetObjectOptions{})
+// GetObject returns an object reader that verifies the checksum of the
+// object as it is read
+func (m *MinIOClient) GetObject(ctx context.Context, objectName string) (io.ReadCloser, error) {
+	var object *minio.Object
+	var info minio.ObjectInfo
+	err := m.withReadKey(objectName, func(key encrypt.ServerSide) error {
+		candidate, err := m.client.GetObject(ctx, m.bucket, objectName, minio.GetObjectOptions{ServerSideEncryption: key, Checksum: true})
+		if err != nil {
+			return err
+		}
+		// The request is only sent on first use, a wrong key fails here
+		if info, err = candidate.Stat(); err != nil {
+			candidate.Close()
+			return err
+		}
+		object = candidate
+		return nil
+	})
 	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrObjectNotFound
+		}
 		return nil, fmt.Errorf("failed to get object: %w", err)
 	}
-	return object, nil
+	checksum, partSize := checksumOf(info)
+	return newVerifyingReader(object, objectName, checksum, partSize, info.Size), nil
 }
 
 // DeleteFile deletes a file from MinIO
@@ -122,15 +330,156 @@ func (m *MinIOClient) DeleteFile(ctx context.Context, objectName string) error {
 	return nil
 }
 
-// GetPresignedURL generates a presigned URL for downloading
+// CopyObject copies an object within the bucket without downloading it,
+// encrypting the copy with the current key. Objects uploaded through
+// presigned URLs have no checksum yet and streamed objects only a composite
+// one, the SHA-256 of their content is computed by reading the source and
+// stored on the copy.
+func (m *MinIOClient) CopyObject(ctx context.Context, srcName string, destName string) error {
+	info, srcKey, err := m.statWithKey(ctx, srcName)
+	if err == nil {
+		dest := minio.CopyDestOptions{Bucket: m.bucket, Object: destName, Encryption: m.encryption.forWrite(destName)}
+		if contentSHA256(info) == "" {
+			var checksum string
+			checksum, err = m.objectSHA256(ctx, srcName, srcKey)
+			dest.ContentType = info.ContentType
+			dest.UserMetadata = map[string]string{checksumMetaKey: checksum}
+			dest.ReplaceMetadata = true
+		}
+		if err == nil {
+			_, err = m.client.CopyObject(ctx, dest, minio.CopySrcOptions{Bucket: m.bucket, Object: srcName, Encryption: srcKey})
+		}
+	}
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return ErrObjectNotFound
+		}
+		return fmt.Errorf("failed to copy object: %w", err)
+	}
+	return nil
+}
+
+// objectSHA256 computes the checksum of a stored object by reading it
+func (m *MinIOClient) objectSHA256(ctx context.Context, objectName string, key encrypt.ServerSide) (string, error) {
+	object, err := m.client.GetObject(ctx, m.bucket, objectName, minio.GetObjectOptions{ServerSideEncryption: key})
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, object); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// RotateKey re-encrypts an object written with an older SSE-C key, or
+// stored before encryption was enabled, with the current key. It reports
+// whether the object was rewritten.
+func (m *MinIOClient) RotateKey(ctx context.Context, objectName string) (bool, error) {
+	if !m.encryption.Enabled() {
+		return false, nil
+	}
+
+	info, srcKey, err := m.statWithKey(ctx, objectName)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	current := m.encryption.forWrite(objectName)
+	if m.encryption.CustomerKeys() {
+		if srcKey == current {
+			return false, nil
+		}
+	} else if info.Metadata.Get(encrypt.SseGenericHeader) != "" {
+		return false, nil
+	}
+
+	// Copying an object onto itself rewrites it with the new encryption
+	_, err = m.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: m.bucket, Object: objectName, Encryption: current},
+		minio.CopySrcOptions{Bucket: m.bucket, Object: objectName, Encryption: srcKey},
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to re-encrypt object: %w", err)
+	}
+	return true, nil
+}
+
+// GetPresignedURL generates a presigned URL for downloading, valid for
+// PRESIGNED_URL_TTL
 func (m *MinIOClient) GetPresignedURL(ctx context.Context, objectName string) (string, error) {
-	url, err := m.client.PresignedGetObject(ctx, m.bucket, objectName, time.Hour, nil)
+	// The key would have to be sent by the browser
+	if m.encryption.CustomerKeys() {
+		return "", ErrPresignUnsupported
+	}
+	url, err := m.presignClient.PresignedGetObject(ctx, m.bucket, objectName, m.presignTTL, nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate presigned URL: %w", err)
 	}
 	return url.String(), nil
 }
 
+// PresignUpload generates a presigned POST policy for uploading one object
+// of the given content type and at most maxSize bytes, which the store
+// enforces. With SSE-C the uploaded object is not encrypted with a customer
+// key until it is copied to its final key.
+func (m *MinIOClient) PresignUpload(ctx context.Context, objectName string, contentType string, maxSize int64, expires time.Duration) (*UploadTarget, error) {
+	policy := minio.NewPostPolicy()
+	policy.SetBucket(m.bucket)
+	policy.SetKey(objectName)
+	policy.SetContentType(contentType)
+	if err := policy.SetExpires(time.Now().UTC().Add(expires)); err != nil {
+		return nil, err
+	}
+	if err := policy.SetContentLengthRange(1, maxSize); err != nil {
+		return nil, err
+	}
+
+	url, fields, err := m.presignClient.PresignedPostPolicy(ctx, policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate presigned upload: %w", err)
+	}
+	return &UploadTarget{URL: url.String(), Method: http.MethodPost, Fields: fields}, nil
+}
+
+// Stat returns the size and content type of an object
+func (m *MinIOClient) Stat(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	info, _, err := m.statWithKey(ctx, objectName)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	return &ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+		SHA256:       contentSHA256(info),
+	}, nil
+}
+
+// List returns all objects whose key starts with prefix
+func (m *MinIOClient) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for info := range m.client.ListObjects(ctx, m.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", info.Err)
+		}
+		objects = append(objects, ObjectInfo{
+			Key:          info.Key,
+			Size:         info.Size,
+			ContentType:  info.ContentType,
+			LastModified: info.LastModified,
+		})
+	}
+	return objects, nil
+}
+
 // GenerateObjectName creates a unique object name with folder structure
 func GenerateObjectName(userID uint, filename string) string {
 	ext := filepath.Ext(filename)
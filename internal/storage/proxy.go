@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// objectsRoute is the authenticated API route objects are streamed through
+// in proxy mode
+const objectsRoute = "/api/objects/"
+
+// ProxyStore hands out links to objectsRoute instead of presigned URLs,
+// for deployments where browsers cannot reach the object store. Links are
+// built on PROXY_BASE_URL, the public URL of the API, and are relative
+// when it is not set. Uploads still use presigned URLs.
+type ProxyStore struct {
+	ObjectStore
+	baseURL string
+}
+
+func NewProxyStore(store ObjectStore) *ProxyStore {
+	return &ProxyStore{
+		ObjectStore: store,
+		baseURL:     strings.TrimRight(os.Getenv("PROXY_BASE_URL"), "/"),
+	}
+}
+
+// GetPresignedURL returns the API link of an object, which needs the
+// user's session rather than a signature
+func (s *ProxyStore) GetPresignedURL(ctx context.Context, objectName string) (string, error) {
+	return s.baseURL + objectsRoute + (&url.URL{Path: objectName}).EscapedPath(), nil
+}
+
+// ProxyDownloads reports whether downloads are streamed through the API,
+// selected by STORAGE_URL_MODE: "presigned" or "proxy". SSE-C objects
+// cannot be presigned, so proxy mode is the default and the only mode
+// allowed with customer keys.
+func ProxyDownloads(store ObjectStore) (bool, error) {
+	minioStore, ok := store.(*MinIOClient)
+	customerKeys := ok && minioStore.encryption.CustomerKeys()
+
+	switch mode := os.Getenv("STORAGE_URL_MODE"); mode {
+	case "":
+		return customerKeys, nil
+	case "presigned":
+		if customerKeys {
+			return false, fmt.Errorf("STORAGE_URL_MODE=presigned cannot be used with SSE-C")
+		}
+		return false, nil
+	case "proxy":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown storage URL mode: %s", mode)
+	}
+}
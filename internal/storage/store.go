@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrObjectNotFound is returned when an object does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	LastModified time.Time `json:"last_modified"`
+	// SHA256 is the hex SHA-256 of the object's content, empty in listings
+	// and for objects stored without one or only with a composite checksum
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// UploadTarget is a presigned request a client sends a file to storage
+// with. POST targets take Fields as form fields before the file field,
+// PUT targets take the file as the body with Headers set.
+type UploadTarget struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// ObjectStore stores user images and processing results under slash
+// separated keys such as users/1/output/<uuid>.nii
+type ObjectStore interface {
+	UploadFile(ctx context.Context, objectName string, filePath string, contentType string) (string, error)
+	UploadFromReader(ctx context.Context, objectName string, reader io.Reader, size int64, contentType string) (string, error)
+	DownloadFile(ctx context.Context, objectName string, destPath string) error
+	GetObject(ctx context.Context, objectName string) (io.ReadCloser, error)
+	DeleteFile(ctx context.Context, objectName string) error
+	CopyObject(ctx context.Context, srcName string, destName string) error
+	GetPresignedURL(ctx context.Context, objectName string) (string, error)
+	PresignUpload(ctx context.Context, objectName string, contentType string, maxSize int64, expires time.Duration) (*UploadTarget, error)
+	Stat(ctx context.Context, objectName string) (*ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// presignedURLTTL is how long download URLs stay valid, PRESIGNED_URL_TTL
+// (default 1h)
+func presignedURLTTL() (time.Duration, error) {
+	value := os.Getenv("PRESIGNED_URL_TTL")
+	if value == "" {
+		return time.Hour, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid PRESIGNED_URL_TTL: %q", value)
+	}
+	return ttl, nil
+}
+
+// NewObjectStore creates the store selected by STORAGE_BACKEND: "minio"
+// (default) or "local"
+func NewObjectStore() (ObjectStore, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "minio":
+		return NewMinIOClient()
+	case "local":
+		if os.Getenv("STORAGE_SSE") != "" {
+			return nil, fmt.Errorf("server-side encryption requires the minio storage backend")
+		}
+		return NewLocalStore()
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", backend)
+	}
+}
@@ -0,0 +1,138 @@
+package imaging
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// BatchBackend is implemented by backends that can run several volumes of
+// the same shape in one request. Outputs are returned in input order.
+type BatchBackend interface {
+	InferenceBackend
+	InferBatch(ctx context.Context, inputNiiPaths []string) ([]string, error)
+}
+
+// Batcher collects concurrent Infer calls with the same input shape and
+// sends them to the backend together once maxSize calls are waiting or
+// maxWait has passed since the first one
+type Batcher struct {
+	backend BatchBackend
+	maxSize int
+	maxWait time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingBatch // keyed by input shape
+}
+
+type pendingBatch struct {
+	items []*batchItem
+}
+
+type batchItem struct {
+	ctx          context.Context
+	inputNiiPath string
+	done         chan batchResult
+}
+
+type batchResult struct {
+	outputPath string
+	err        error
+}
+
+func NewBatcher(backend BatchBackend, maxSize int, maxWait time.Duration) *Batcher {
+	return &Batcher{
+		backend: backend,
+		maxSize: maxSize,
+		maxWait: maxWait,
+		pending: map[string]*pendingBatch{},
+	}
+}
+
+func (b *Batcher) Name() string {
+	return b.backend.Name()
+}
+
+// HealthCheck forwards to the wrapped backend when it supports health checks
+func (b *Batcher) HealthCheck(ctx context.Context) error {
+	if checker, ok := b.backend.(HealthChecker); ok {
+		return checker.HealthCheck(ctx)
+	}
+	return nil
+}
+
+// Infer queues the volume and waits for the batch it joins to finish
+func (b *Batcher) Infer(ctx context.Context, inputNiiPath string) (string, error) {
+	header, err := ReadNiftiHeader(inputNiiPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read input volume: %w", err)
+	}
+	key := fmt.Sprint(header.dims3())
+
+	item := &batchItem{ctx: ctx, inputNiiPath: inputNiiPath, done: make(chan batchResult, 1)}
+
+	b.mu.Lock()
+	batch, ok := b.pending[key]
+	if !ok {
+		batch = &pendingBatch{}
+		b.pending[key] = batch
+		time.AfterFunc(b.maxWait, func() { b.flush(key, batch) })
+	}
+	batch.items = append(batch.items, item)
+	full := len(batch.items) >= b.maxSize
+	b.mu.Unlock()
+
+	if full {
+		b.flush(key, batch)
+	}
+
+	select {
+	case result := <-item.done:
+		return result.outputPath, result.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// flush sends a batch unless it was already sent
+func (b *Batcher) flush(key string, batch *pendingBatch) {
+	b.mu.Lock()
+	if b.pending[key] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, key)
+	b.mu.Unlock()
+
+	go b.run(batch.items)
+}
+
+func (b *Batcher) run(items []*batchItem) {
+	// Skip callers that gave up while waiting
+	live := make([]*batchItem, 0, len(items))
+	paths := make([]string, 0, len(items))
+	for _, item := range items {
+		if item.ctx.Err() == nil {
+			live = append(live, item)
+			paths = append(paths, item.inputNiiPath)
+		}
+	}
+	if len(live) == 0 {
+		return
+	}
+
+	outputs, err := b.backend.InferBatch(context.Background(), paths)
+	for i, item := range live {
+		if err != nil {
+			item.done <- batchResult{err: err}
+			continue
+		}
+		if item.ctx.Err() != nil {
+			os.Remove(outputs[i])
+			continue
+		}
+		item.done <- batchResult{outputPath: outputs[i]}
+	}
+}
@@ -0,0 +1,69 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// ErrIncompatibleGeometry is returned when two volumes cannot be compared voxel by voxel
+var ErrIncompatibleGeometry = errors.New("incompatible volume geometry")
+
+// LabelDelta holds the volume of a single label in both volumes
+type LabelDelta struct {
+	Label        int      `json:"label"`
+	VolumeAMM3   float64  `json:"volume_a_mm3"`
+	VolumeBMM3   float64  `json:"volume_b_mm3"`
+	DeltaMM3     float64  `json:"delta_mm3"`
+	DeltaPercent *float64 `json:"delta_percent"`
+}
+
+// Comparison is the result of comparing two label volumes
+type Comparison struct {
+	Shape          []int        `json:"shape"`
+	Spacing        []float64    `json:"spacing"`
+	VoxelVolumeMM3 float64      `json:"voxel_volume_mm3"`
+	Labels         []LabelDelta `json:"labels"`
+}
+
+// CompareNii compares two NII volumes and renders a difference map.
+// It returns the comparison and the path of the rendered PNG.
+func CompareNii(niiPathA string, niiPathB string) (*Comparison, string, error) {
+	outputPath := filepath.Join("/tmp", fmt.Sprintf("%s_diff.png", uuid.New().String()))
+
+	cmd := converterCommand(niiPathA, outputPath, "--compare", niiPathB)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, "", fmt.Errorf("comparison failed: %s - %s", err.Error(), stderr.String())
+	}
+
+	var report struct {
+		Comparison
+		Compatible bool   `json:"compatible"`
+		Reason     string `json:"reason"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		os.Remove(outputPath)
+		return nil, "", fmt.Errorf("failed to parse comparison output: %w", err)
+	}
+
+	if !report.Compatible {
+		os.Remove(outputPath)
+		return nil, "", fmt.Errorf("%w: %s", ErrIncompatibleGeometry, report.Reason)
+	}
+
+	if _, err := os.Stat(outputPath); os.IsNotExist(err) {
+		return nil, "", fmt.Errorf("difference map not created")
+	}
+
+	return &report.Comparison, outputPath, nil
+}
@@ -4,35 +4,36 @@ package imaging
 import (
 	"bytes"
 	"fmt"
-	"io"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/google/uuid"
 )
 
-// ConvertToNii converts an image to NII format using Python script
+// ConvertToNii converts an image to NII format using Python script.
+// Multi-page TIFFs become a 3D volume with one slice per page.
+// NRRD and MetaImage volumes are converted natively.
 func ConvertToNii(imagePath string) (string, error) {
 	// Generate output path
 	outputPath := filepath.Join("/tmp", fmt.Sprintf("%s.nii", uuid.New().String()))
 
-	// Get Python script path
-	scriptPath := os.Getenv("PYTHON_CONVERTER_SCRIPT")
-	if scriptPath == "" {
-		scriptPath = "scripts/convert_to_nii.py"
-	}
-
-	// Get Python executable
-	pythonExec := os.Getenv("PYTHON_EXECUTABLE")
-	if pythonExec == "" {
-		pythonExec = "python3"
+	if isVolumeFile(imagePath) {
+		volume, err := ReadVolume(imagePath)
+		if err != nil {
+			return "", fmt.Errorf("conversion failed: %w", err)
+		}
+		if err := WriteNifti(outputPath, volume); err != nil {
+			os.Remove(outputPath)
+			return "", fmt.Errorf("conversion failed: %w", err)
+		}
+		return outputPath, nil
 	}
 
 	// Execute Python script
-	cmd := exec.Command(pythonExec, scriptPath, imagePath, outputPath)
+	cmd := converterCommand(imagePath, outputPath)
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
@@ -51,25 +52,42 @@ func ConvertToNii(imagePath string) (string, error) {
 	return outputPath, nil
 }
 
-// ConvertNiiToImage converts NII back to image format
+// ConvertNiiToImage converts NII back to image format. The "nrrd", "mha"
+// and "mhd" formats export the full volume instead of a rendered slice,
+// "mhd" as a zip archive of result.mhd and result.raw.
 func ConvertNiiToImage(niiPath string, outputFormat string) (string, error) {
 	if outputFormat == "" {
 		outputFormat = "png"
 	}
 
-	outputPath := filepath.Join("/tmp", fmt.Sprintf("%s.%s", uuid.New().String(), outputFormat))
-
-	scriptPath := os.Getenv("PYTHON_CONVERTER_SCRIPT")
-	if scriptPath == "" {
-		scriptPath = "scripts/convert_to_nii.py"
+	if outputFormat == "mhd" {
+		volume, err := ReadNifti(niiPath)
+		if err != nil {
+			return "", fmt.Errorf("conversion failed: %w", err)
+		}
+		outputPath := filepath.Join("/tmp", fmt.Sprintf("%s.zip", uuid.New().String()))
+		if err := WriteMetaImageArchive(outputPath, volume, "result"); err != nil {
+			os.Remove(outputPath)
+			return "", fmt.Errorf("conversion failed: %w", err)
+		}
+		return outputPath, nil
 	}
 
-	pythonExec := os.Getenv("PYTHON_EXECUTABLE")
-	if pythonExec == "" {
-		pythonExec = "python3"
+	outputPath := filepath.Join("/tmp", fmt.Sprintf("%s.%s", uuid.New().String(), outputFormat))
+
+	if outputFormat == "nrrd" || outputFormat == "mha" {
+		volume, err := ReadNifti(niiPath)
+		if err != nil {
+			return "", fmt.Errorf("conversion failed: %w", err)
+		}
+		if err := WriteVolume(outputPath, volume); err != nil {
+			os.Remove(outputPath)
+			return "", fmt.Errorf("conversion failed: %w", err)
+		}
+		return outputPath, nil
 	}
 
-	cmd := exec.Command(pythonExec, scriptPath, niiPath, outputPath, "--reverse")
+	cmd := converterCommand(niiPath, outputPath, "--reverse")
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
@@ -87,76 +105,47 @@ func ConvertNiiToImage(niiPath string, outputFormat string) (string, error) {
 	return outputPath, nil
 }
 
-// CallModel sends NII file to your model and gets the result
-func CallModel(inputNiiPath string) (string, error) {
-	return inputNiiPath, nil // TODO: remove this line when implementing the function
-
-	modelURL := os.Getenv("MODEL_URL")
-	if modelURL == "" {
-		return "", fmt.Errorf("MODEL_URL not set in environment")
-	}
-
-	// Open the input file
-	file, err := os.Open(inputNiiPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to open input file: %w", err)
-	}
-	defer file.Close()
-
-	// Create multipart form
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	part, err := writer.CreateFormFile("file", filepath.Base(inputNiiPath))
-	if err != nil {
-		return "", fmt.Errorf("failed to create form file: %w", err)
-	}
-
-	_, err = io.Copy(part, file)
-	if err != nil {
-		return "", fmt.Errorf("failed to copy file: %w", err)
-	}
-
-	writer.Close()
-
-	// Send request to model
-	req, err := http.NewRequest("POST", modelURL, body)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to call model: %w", err)
+// converterCommand builds a command running the Python converter script
+func converterCommand(args ...string) *exec.Cmd {
+	scriptPath := os.Getenv("PYTHON_CONVERTER_SCRIPT")
+	if scriptPath == "" {
+		scriptPath = "scripts/convert_to_nii.py"
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("model returned error %d: %s", resp.StatusCode, string(bodyBytes))
+	pythonExec := os.Getenv("PYTHON_EXECUTABLE")
+	if pythonExec == "" {
+		pythonExec = "python3"
 	}
 
-	// Save the output NII file
-	outputPath := filepath.Join("/tmp", fmt.Sprintf("%s_output.nii", uuid.New().String()))
-
-	outFile, err := os.Create(outputPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to create output file: %w", err)
-	}
-	defer outFile.Close()
+	return exec.Command(pythonExec, append([]string{scriptPath}, args...)...)
+}
 
-	_, err = io.Copy(outFile, resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to save output file: %w", err)
-	}
+// uploadContentTypes maps accepted upload extensions to their content type
+var uploadContentTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".webp": "image/webp",
+	".nrrd": "application/octet-stream",
+	".mha":  "application/octet-stream",
+}
 
-	return outputPath, nil
+// UploadContentType returns the content type for an accepted upload extension
+func UploadContentType(ext string) (string, bool) {
+	contentType, ok := uploadContentTypes[strings.ToLower(ext)]
+	return contentType, ok
 }
 
-// ValidateImageFile checks if file is a valid image
+// ValidateImageFile checks if file is a valid image. NRRD and MetaImage
+// volumes are validated by parsing their header.
 func ValidateImageFile(filepath string) error {
+	if isVolumeFile(filepath) {
+		_, err := readVolumeHeader(filepath)
+		return err
+	}
+
 	file, err := os.Open(filepath)
 	if err != nil {
 		return err
@@ -165,16 +154,34 @@ func ValidateImageFile(filepath string) error {
 
 	// Read first 512 bytes to detect file type
 	buffer := make([]byte, 512)
-	_, err = file.Read(buffer)
+	n, err := file.Read(buffer)
 	if err != nil {
 		return err
 	}
 
-	contentType := http.DetectContentType(buffer)
+	contentType := DetectContentType(buffer[:n])
 
-	if contentType != "image/jpeg" && contentType != "image/png" {
-		return fmt.Errorf("invalid file type: %s, only JPEG and PNG allowed", contentType)
+	switch contentType {
+	case "image/jpeg", "image/png", "image/tiff", "image/webp":
+		return nil
 	}
 
-	return nil
+	return fmt.Errorf("invalid file type: %s, only JPEG, PNG, TIFF and WebP allowed", contentType)
+}
+
+// DetectContentType extends http.DetectContentType with TIFF signatures
+func DetectContentType(header []byte) string {
+	// Little and big endian TIFF, and BigTIFF
+	for _, magic := range [][]byte{
+		{'I', 'I', 42, 0},
+		{'M', 'M', 0, 42},
+		{'I', 'I', 43, 0},
+		{'M', 'M', 0, 43},
+	} {
+		if bytes.HasPrefix(header, magic) {
+			return "image/tiff"
+		}
+	}
+
+	return http.DetectContentType(header)
 }
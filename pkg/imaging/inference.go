@@ -0,0 +1,171 @@
+package imaging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// InferenceBackend runs the segmentation model on a NIfTI volume and
+// returns the path of the output NIfTI file. The caller removes the
+// output file when done.
+type InferenceBackend interface {
+	Name() string
+	Infer(ctx context.Context, inputNiiPath string) (string, error)
+}
+
+// StreamingBackend is implemented by backends that can send the input and
+// receive the output as streams, so whole volumes are never buffered. The
+// returned reader yields the uncompressed output NIfTI and must be closed.
+type StreamingBackend interface {
+	InferStream(ctx context.Context, input io.Reader, filename string) (io.ReadCloser, error)
+}
+
+// HealthChecker is implemented by backends that can report whether the
+// model server is ready to accept requests
+type HealthChecker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+// BackendConfig describes how to reach a model server
+type BackendConfig struct {
+	Kind       string // http, kserve, grpc, callback or stub
+	Endpoint   string // URL for http, kserve and callback, host:port for grpc
+	Model      string // model name on a KServe server
+	Version    string // model version on a KServe server
+	InputName  string // KServe input tensor name
+	OutputName string // KServe output tensor name
+	BinaryData bool   // use the KServe binary tensor extension
+	TLS        bool   // use TLS for grpc
+
+	BatchSize int           // batch up to this many kserve requests, 0 or 1 disables batching
+	BatchWait time.Duration // longest time a request waits for its batch to fill
+}
+
+// NewInferenceBackend creates the default backend selected by
+// INFERENCE_BACKEND: "http" (default), "kserve", "grpc", "callback" or
+// "stub". A kserve backend batches requests when MODEL_BATCH_SIZE is above
+// one, waiting at most MODEL_BATCH_WAIT for a batch to fill.
+func NewInferenceBackend() (InferenceBackend, error) {
+	config := BackendConfig{Kind: os.Getenv("INFERENCE_BACKEND")}
+	if config.Kind == "" {
+		config.Kind = "http"
+	}
+
+	switch config.Kind {
+	case "http":
+		config.Endpoint = os.Getenv("MODEL_URL")
+		if config.Endpoint == "" {
+			return nil, fmt.Errorf("MODEL_URL not set in environment")
+		}
+	case "kserve":
+		config.Endpoint = os.Getenv("KSERVE_URL")
+		config.Model = os.Getenv("KSERVE_MODEL")
+		if config.Endpoint == "" || config.Model == "" {
+			return nil, fmt.Errorf("KSERVE_URL and KSERVE_MODEL must be set in environment")
+		}
+		config.Version = os.Getenv("KSERVE_MODEL_VERSION")
+		config.InputName = os.Getenv("KSERVE_INPUT_NAME")
+		config.OutputName = os.Getenv("KSERVE_OUTPUT_NAME")
+		config.BinaryData = os.Getenv("KSERVE_BINARY_DATA") == "true"
+		if value := os.Getenv("MODEL_BATCH_SIZE"); value != "" {
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid MODEL_BATCH_SIZE: %w", err)
+			}
+			config.BatchSize = size
+		}
+		if value := os.Getenv("MODEL_BATCH_WAIT"); value != "" {
+			wait, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid MODEL_BATCH_WAIT: %w", err)
+			}
+			config.BatchWait = wait
+		}
+	case "grpc":
+		config.Endpoint = os.Getenv("GRPC_MODEL_TARGET")
+		if config.Endpoint == "" {
+			return nil, fmt.Errorf("GRPC_MODEL_TARGET not set in environment")
+		}
+		config.TLS = os.Getenv("GRPC_MODEL_TLS") == "true"
+	case "callback":
+		config.Endpoint = os.Getenv("MODEL_URL")
+		if config.Endpoint == "" {
+			return nil, fmt.Errorf("MODEL_URL not set in environment")
+		}
+	}
+
+	return NewInferenceBackendFromConfig(config)
+}
+
+// NewInferenceBackendFromConfig creates a backend for a model server.
+// Timeout and auth header are shared by all backends and read from
+// MODEL_TIMEOUT, MODEL_AUTH_HEADER and MODEL_AUTH_VALUE. The callback
+// backend also reads CALLBACK_BASE_URL, the externally reachable URL of
+// this server.
+func NewInferenceBackendFromConfig(config BackendConfig) (InferenceBackend, error) {
+	timeout := 5 * time.Minute
+	if value := os.Getenv("MODEL_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MODEL_TIMEOUT: %w", err)
+		}
+		timeout = parsed
+	}
+
+	authHeader := os.Getenv("MODEL_AUTH_HEADER")
+	if authHeader == "" {
+		authHeader = "Authorization"
+	}
+	authValue := os.Getenv("MODEL_AUTH_VALUE")
+
+	if config.BatchSize > 1 && config.Kind != "kserve" {
+		return nil, fmt.Errorf("batching is only supported by the kserve backend")
+	}
+
+	switch config.Kind {
+	case "http":
+		if config.Endpoint == "" {
+			return nil, fmt.Errorf("http backend requires an endpoint URL")
+		}
+		return NewHTTPBackend(config.Endpoint, timeout, authHeader, authValue), nil
+	case "kserve":
+		if config.Endpoint == "" || config.Model == "" {
+			return nil, fmt.Errorf("kserve backend requires an endpoint URL and model name")
+		}
+		backend := NewKServeBackend(config.Endpoint, config.Model, config.Version, timeout)
+		if config.InputName != "" {
+			backend.inputName = config.InputName
+		}
+		backend.outputName = config.OutputName
+		backend.binary = config.BinaryData
+		backend.authHeader = authHeader
+		backend.authValue = authValue
+		if config.BatchSize > 1 {
+			wait := config.BatchWait
+			if wait <= 0 {
+				wait = 50 * time.Millisecond
+			}
+			return NewBatcher(backend, config.BatchSize, wait), nil
+		}
+		return backend, nil
+	case "grpc":
+		if config.Endpoint == "" {
+			return nil, fmt.Errorf("grpc backend requires a target address")
+		}
+		return NewGRPCBackend(config.Endpoint, config.TLS, timeout, authHeader, authValue)
+	case "callback":
+		callbackBaseURL := os.Getenv("CALLBACK_BASE_URL")
+		if config.Endpoint == "" || callbackBaseURL == "" {
+			return nil, fmt.Errorf("callback backend requires an endpoint URL and CALLBACK_BASE_URL")
+		}
+		return NewCallbackBackend(config.Endpoint, callbackBaseURL, timeout, authHeader, authValue), nil
+	case "stub":
+		return NewStubBackend(), nil
+	}
+
+	return nil, fmt.Errorf("unknown inference backend: %s", config.Kind)
+}
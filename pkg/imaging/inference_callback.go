@@ -0,0 +1,108 @@
+package imaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrAsyncBackend is returned by Infer on backends that only deliver
+// results through a callback
+var ErrAsyncBackend = errors.New("backend delivers results asynchronously")
+
+// AsyncBackend is implemented by backends that accept a job and POST the
+// output NIfTI to a callback URL once it is ready
+type AsyncBackend interface {
+	Submit(ctx context.Context, inputNiiPath string, callbackPath string) error
+}
+
+// CallbackBackend submits the input volume to a batch system together with
+// a callback URL. The batch system later POSTs the output to that URL,
+// signed with the shared CALLBACK_SECRET.
+type CallbackBackend struct {
+	url             string
+	callbackBaseURL string
+	authHeader      string
+	authValue       string
+	client          *http.Client
+}
+
+func NewCallbackBackend(url string, callbackBaseURL string, timeout time.Duration, authHeader string, authValue string) *CallbackBackend {
+	return &CallbackBackend{
+		url:             url,
+		callbackBaseURL: strings.TrimRight(callbackBaseURL, "/"),
+		authHeader:      authHeader,
+		authValue:       authValue,
+		client:          &http.Client{Timeout: timeout},
+	}
+}
+
+func (b *CallbackBackend) Name() string {
+	return "callback"
+}
+
+// Infer is not supported, results arrive through Submit's callback
+func (b *CallbackBackend) Infer(ctx context.Context, inputNiiPath string) (string, error) {
+	return "", ErrAsyncBackend
+}
+
+// Submit posts the NII file and the callback URL as a multipart form. The
+// callback path is appended to CALLBACK_BASE_URL.
+func (b *CallbackBackend) Submit(ctx context.Context, inputNiiPath string, callbackPath string) error {
+	file, err := os.Open(inputNiiPath)
+	if err != nil {
+		return fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer file.Close()
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		if err := writer.WriteField("callback_url", b.callbackBaseURL+callbackPath); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		part, err := writer.CreateFormFile("file", filepath.Base(inputNiiPath))
+		if err != nil {
+			pw.CloseWithError(fmt.Errorf("failed to create form file: %w", err))
+			return
+		}
+		if _, err := io.Copy(part, file); err != nil {
+			pw.CloseWithError(fmt.Errorf("failed to copy file: %w", err))
+			return
+		}
+		pw.CloseWithError(writer.Close())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url, pr)
+	if err != nil {
+		pr.Close()
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if b.authValue != "" {
+		req.Header.Set(b.authHeader, b.authValue)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		pr.Close()
+		return fmt.Errorf("failed to submit job: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusAccepted:
+		return nil
+	}
+
+	bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("model returned error %d: %s", resp.StatusCode, string(bodyBytes))
+}
@@ -0,0 +1,219 @@
+package imaging
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	grpcSegmentMethod = "/segmentation.v1.Inference/Segment"
+	grpcHealthService = "segmentation.v1.Inference"
+	grpcChunkSize     = 1 << 20
+	grpcHealthTimeout = 5 * time.Second
+)
+
+var grpcSegmentStream = &grpc.StreamDesc{
+	StreamName:    "Segment",
+	ClientStreams: true,
+	ServerStreams: true,
+}
+
+// GRPCBackend streams the input volume to a model server in chunks and
+// streams the output back, so neither volume is held in memory. See proto/inference.proto for the service contract.
+type GRPCBackend struct {
+	conn       *grpc.ClientConn
+	health     healthpb.HealthClient
+	timeout    time.Duration
+	authHeader string
+	authValue  string
+}
+
+func NewGRPCBackend(target string, useTLS bool, timeout time.Duration, authHeader string, authValue string) (*GRPCBackend, error) {
+	creds := insecure.NewCredentials()
+	if useTLS {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC client: %w", err)
+	}
+
+	return &GRPCBackend{
+		conn:       conn,
+		health:     healthpb.NewHealthClient(conn),
+		timeout:    timeout,
+		authHeader: strings.ToLower(authHeader),
+		authValue:  authValue,
+	}, nil
+}
+
+func (b *GRPCBackend) Name() string {
+	return "grpc"
+}
+
+// Close closes the underlying connection
+func (b *GRPCBackend) Close() error {
+	return b.conn.Close()
+}
+
+func (b *GRPCBackend) outgoingContext(ctx context.Context) context.Context {
+	if b.authValue == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, b.authHeader, b.authValue)
+}
+
+// HealthCheck asks the server whether the inference service is serving
+func (b *GRPCBackend) HealthCheck(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(b.outgoingContext(ctx), grpcHealthTimeout)
+	defer cancel()
+
+	resp, err := b.health.Check(ctx, &healthpb.HealthCheckRequest{Service: grpcHealthService})
+	if err != nil {
+		return fmt.Errorf("health check failed: %w", err)
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("model server is %s", resp.GetStatus())
+	}
+	return nil
+}
+
+func (b *GRPCBackend) Infer(ctx context.Context, inputNiiPath string) (string, error) {
+	input, err := os.Open(inputNiiPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer input.Close()
+
+	output, err := b.InferStream(ctx, input, filepath.Base(inputNiiPath))
+	if err != nil {
+		return "", err
+	}
+	defer output.Close()
+
+	outputPath := filepath.Join("/tmp", fmt.Sprintf("%s_output.nii", uuid.New().String()))
+	if err := saveNiftiResponse(output, outputPath); err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+
+	return outputPath, nil
+}
+
+// InferStream uploads the input in chunks and returns the output chunks as
+// a single stream. Closing the reader cancels the call.
+func (b *GRPCBackend) InferStream(ctx context.Context, input io.Reader, filename string) (io.ReadCloser, error) {
+	if err := b.HealthCheck(ctx); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(b.outgoingContext(ctx), b.timeout)
+
+	stream, err := b.conn.NewStream(ctx, grpcSegmentStream, grpcSegmentMethod)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to open inference stream: %w", err)
+	}
+
+	// Upload in the background so the server may stream results early
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- sendChunks(stream, input)
+	}()
+
+	pr, pw := io.Pipe()
+	go func() {
+		if err := receiveChunks(stream, pw); err != nil {
+			cancel()
+			<-sendErr
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(<-sendErr)
+	}()
+
+	output, err := decompressNifti(pr)
+	if err != nil {
+		cancel()
+		pr.Close()
+		return nil, fmt.Errorf("failed to decompress model output: %w", err)
+	}
+
+	return &responseReader{Reader: output, closers: []io.Closer{output, pr, cancelCloser(cancel)}}, nil
+}
+
+// cancelCloser cancels a context when closed
+type cancelCloser context.CancelFunc
+
+func (c cancelCloser) Close() error {
+	c()
+	return nil
+}
+
+func sendChunks(stream grpc.ClientStream, input io.Reader) error {
+	buffer := make([]byte, grpcChunkSize)
+	for {
+		n, err := input.Read(buffer)
+		if n > 0 {
+			if sendErr := stream.SendMsg(wrapperspb.Bytes(buffer[:n])); sendErr != nil {
+				// The real error is reported by RecvMsg
+				if errors.Is(sendErr, io.EOF) {
+					return nil
+				}
+				return fmt.Errorf("failed to send input chunk: %w", sendErr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read input file: %w", err)
+		}
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		return fmt.Errorf("failed to finish upload: %w", err)
+	}
+	return nil
+}
+
+func receiveChunks(stream grpc.ClientStream, output io.Writer) error {
+	var received int64
+	for {
+		chunk := &wrapperspb.BytesValue{}
+		err := stream.RecvMsg(chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to call model: %w", err)
+		}
+
+		n, err := output.Write(chunk.GetValue())
+		if err != nil {
+			return fmt.Errorf("failed to save output file: %w", err)
+		}
+		received += int64(n)
+	}
+
+	if received == 0 {
+		return fmt.Errorf("model returned an empty response")
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package imaging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// HTTPBackend posts the input volume as a multipart form to a model
+// server and expects the output NIfTI file in the response body
+type HTTPBackend struct {
+	url        string
+	authHeader string
+	authValue  string
+	client     *http.Client
+}
+
+func NewHTTPBackend(url string, timeout time.Duration, authHeader string, authValue string) *HTTPBackend {
+	return &HTTPBackend{
+		url:        url,
+		authHeader: authHeader,
+		authValue:  authValue,
+		client:     &http.Client{Timeout: timeout},
+	}
+}
+
+func (b *HTTPBackend) Name() string {
+	return "http"
+}
+
+// Infer sends the NII file to the model and saves the result
+func (b *HTTPBackend) Infer(ctx context.Context, inputNiiPath string) (string, error) {
+	// Open the input file
+	file, err := os.Open(inputNiiPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer file.Close()
+
+	output, err := b.InferStream(ctx, file, filepath.Base(inputNiiPath))
+	if err != nil {
+		return "", err
+	}
+	defer output.Close()
+
+	// Save the output NII file
+	outputPath := filepath.Join("/tmp", fmt.Sprintf("%s_output.nii", uuid.New().String()))
+	if err := saveNiftiResponse(output, outputPath); err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+
+	return outputPath, nil
+}
+
+// InferStream streams the input as a multipart form to the model and
+// returns the decompressed response body
+func (b *HTTPBackend) InferStream(ctx context.Context, input io.Reader, filename string) (io.ReadCloser, error) {
+	// Write the multipart form through a pipe while the request is sent
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		part, err := writer.CreateFormFile("file", filename)
+		if err != nil {
+			pw.CloseWithError(fmt.Errorf("failed to create form file: %w", err))
+			return
+		}
+		if _, err := io.Copy(part, input); err != nil {
+			pw.CloseWithError(fmt.Errorf("failed to copy file: %w", err))
+			return
+		}
+		pw.CloseWithError(writer.Close())
+	}()
+
+	// Send request to model
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url, pr)
+	if err != nil {
+		pr.Close()
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if b.authValue != "" {
+		req.Header.Set(b.authHeader, b.authValue)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		pr.Close()
+		return nil, fmt.Errorf("failed to call model: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("model returned error %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/html" || mediaType == "application/json" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("model returned %s instead of a NIfTI file", mediaType)
+	}
+
+	output, err := decompressNifti(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to decompress model output: %w", err)
+	}
+
+	return &responseReader{Reader: output, closers: []io.Closer{output, resp.Body}}, nil
+}
+
+// responseReader closes the decompressor and the underlying body together
+type responseReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *responseReader) Close() error {
+	var firstErr error
+	for _, closer := range r.closers {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// saveNiftiResponse writes an uncompressed NIfTI stream to a file and
+// checks that it has a valid header
+func saveNiftiResponse(body io.Reader, outputPath string) error {
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outFile.Close()
+
+	written, err := io.Copy(outFile, body)
+	if err != nil {
+		return fmt.Errorf("failed to save output file: %w", err)
+	}
+	if written == 0 {
+		return fmt.Errorf("model returned an empty response")
+	}
+
+	if _, err := readNifti(outputPath, true); err != nil {
+		return fmt.Errorf("model returned an invalid NIfTI file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,403 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	kserveHealthTimeout = 5 * time.Second
+
+	// kserveValueSize bounds one output value in a JSON response, the
+	// longest float64 literal plus its separator
+	kserveValueSize = 32
+	// kserveResponseMargin allows for the JSON header of a response
+	kserveResponseMargin = 1 << 20
+)
+
+// v2 tensor datatypes of the Open Inference Protocol
+var kserveDatatypes = map[string]Datatype{
+	"BOOL":   Uint8,
+	"UINT8":  Uint8,
+	"INT8":   Int8,
+	"UINT16": Uint16,
+	"INT16":  Int16,
+	"UINT32": Uint32,
+	"INT32":  Int32,
+	"UINT64": Uint64,
+	"INT64":  Int64,
+	"FP32":   Float32,
+	"FP64":   Float64,
+}
+
+type kserveTensor struct {
+	Name       string         `json:"name"`
+	Shape      []int          `json:"shape"`
+	Datatype   string         `json:"datatype"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+	Data       []float64      `json:"data,omitempty"`
+}
+
+type kserveOutputRequest struct {
+	Name       string         `json:"name"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+}
+
+type kserveRequest struct {
+	ID         string                `json:"id"`
+	Parameters map[string]any        `json:"parameters,omitempty"`
+	Inputs     []kserveTensor        `json:"inputs"`
+	Outputs    []kserveOutputRequest `json:"outputs,omitempty"`
+}
+
+type kserveResponse struct {
+	ModelName string         `json:"model_name"`
+	Outputs   []kserveTensor `json:"outputs"`
+	Error     string         `json:"error"`
+}
+
+// KServeBackend speaks the Open Inference Protocol (KServe / Triton v2).
+// Volumes are sent as a float32 tensor of shape [n, z, y, x] and the
+// output tensor is written back into NIfTIs with the inputs' affines.
+type KServeBackend struct {
+	baseURL    string
+	model      string
+	version    string
+	inputName  string
+	outputName string
+	binary     bool
+	authHeader string
+	authValue  string
+	client     *http.Client
+}
+
+func NewKServeBackend(baseURL string, model string, version string, timeout time.Duration) *KServeBackend {
+	return &KServeBackend{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		model:     model,
+		version:   version,
+		inputName: "input",
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+func (b *KServeBackend) Name() string {
+	return "kserve"
+}
+
+func (b *KServeBackend) modelURL() string {
+	path := "/v2/models/" + url.PathEscape(b.model)
+	if b.version != "" {
+		path += "/versions/" + url.PathEscape(b.version)
+	}
+	return b.baseURL + path
+}
+
+func (b *KServeBackend) inferURL() string {
+	return b.modelURL() + "/infer"
+}
+
+// HealthCheck asks the server whether the model is ready
+func (b *KServeBackend) HealthCheck(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, kserveHealthTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.modelURL()+"/ready", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if b.authValue != "" {
+		req.Header.Set(b.authHeader, b.authValue)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("model is not ready: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (b *KServeBackend) Infer(ctx context.Context, inputNiiPath string) (string, error) {
+	outputs, err := b.InferBatch(ctx, []string{inputNiiPath})
+	if err != nil {
+		return "", err
+	}
+	return outputs[0], nil
+}
+
+// InferBatch sends volumes of the same shape as one tensor of shape
+// [n, z, y, x] and splits the output back into one NIfTI per input
+func (b *KServeBackend) InferBatch(ctx context.Context, inputNiiPaths []string) ([]string, error) {
+	inputs := make([]*Volume, len(inputNiiPaths))
+	for i, path := range inputNiiPaths {
+		input, err := ReadNifti(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read input volume: %w", err)
+		}
+		if i > 0 && !equalInts(input.dims3(), inputs[0].dims3()) {
+			return nil, fmt.Errorf("batch inputs have different dimensions: %v and %v", inputs[0].Dims, input.Dims)
+		}
+		inputs[i] = input
+	}
+
+	input := inputs[0]
+	n := input.NumVoxels()
+	shape := []int{len(inputs)}
+	for i := len(input.Dims) - 1; i >= 0; i-- {
+		// NIfTI stores x fastest, which is row-major order for [z, y, x]
+		shape = append(shape, input.Dims[i])
+	}
+
+	tensor := kserveTensor{
+		Name:     b.inputName,
+		Shape:    shape,
+		Datatype: "FP32",
+	}
+	request := kserveRequest{ID: uuid.New().String(), Inputs: []kserveTensor{tensor}}
+
+	if b.outputName != "" {
+		output := kserveOutputRequest{Name: b.outputName}
+		if b.binary {
+			output.Parameters = map[string]any{"binary_data": true}
+		}
+		request.Outputs = []kserveOutputRequest{output}
+	} else if b.binary {
+		request.Parameters = map[string]any{"binary_data_output": true}
+	}
+
+	var body []byte
+	var headerLength int
+	var err error
+	if b.binary {
+		raw := make([]byte, 0, len(inputs)*n*4)
+		for _, input := range inputs {
+			for i := 0; i < n; i++ {
+				raw = binary.LittleEndian.AppendUint32(raw, math.Float32bits(float32(input.Value(i))))
+			}
+		}
+		request.Inputs[0].Parameters = map[string]any{"binary_data_size": len(raw)}
+
+		header, err := json.Marshal(request)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request: %w", err)
+		}
+		headerLength = len(header)
+		body = append(header, raw...)
+	} else {
+		data := make([]float64, 0, len(inputs)*n)
+		for _, input := range inputs {
+			for i := 0; i < n; i++ {
+				data = append(data, float64(float32(input.Value(i))))
+			}
+		}
+		request.Inputs[0].Data = data
+
+		body, err = json.Marshal(request)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.inferURL(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if b.binary {
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Inference-Header-Content-Length", strconv.Itoa(headerLength))
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if b.authValue != "" {
+		req.Header.Set(b.authHeader, b.authValue)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call model: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Outputs have one value per input voxel, at most 8 bytes each in
+	// binary and kserveValueSize as JSON text
+	valueSize := kserveValueSize
+	if b.binary {
+		valueSize = Float64.Size()
+	}
+	limit := int64(len(inputs))*int64(n)*int64(valueSize) + kserveResponseMargin
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model response: %w", err)
+	}
+	if int64(len(respBody)) > limit {
+		return nil, fmt.Errorf("model response exceeds %d bytes", limit)
+	}
+
+	output, err := b.decodeResponse(resp, respBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.writeOutputs(inputs, output)
+}
+
+type kserveOutput struct {
+	tensor kserveTensor
+	raw    []byte
+}
+
+// decodeResponse parses a JSON or binary extension response and returns the
+// selected output tensor
+func (b *KServeBackend) decodeResponse(resp *http.Response, body []byte) (*kserveOutput, error) {
+	headerBody := body
+	var binaryData []byte
+	if value := resp.Header.Get("Inference-Header-Content-Length"); value != "" {
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 0 || length > len(body) {
+			return nil, fmt.Errorf("invalid Inference-Header-Content-Length: %q", value)
+		}
+		headerBody, binaryData = body[:length], body[length:]
+	}
+
+	var response kserveResponse
+	if err := json.Unmarshal(headerBody, &response); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("model returned error %d: %s", resp.StatusCode, truncate(string(body), 512))
+		}
+		return nil, fmt.Errorf("failed to decode model response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || response.Error != "" {
+		return nil, fmt.Errorf("model returned error %d: %s", resp.StatusCode, response.Error)
+	}
+
+	offset := 0
+	for _, tensor := range response.Outputs {
+		var raw []byte
+		if size, ok := tensor.Parameters["binary_data_size"].(float64); ok {
+			end := offset + int(size)
+			if end > len(binaryData) {
+				return nil, fmt.Errorf("binary output %q exceeds response size", tensor.Name)
+			}
+			raw = binaryData[offset:end]
+			offset = end
+		}
+
+		if b.outputName == "" || tensor.Name == b.outputName {
+			return &kserveOutput{tensor: tensor, raw: raw}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("model response has no output %q", b.outputName)
+}
+
+// writeOutputs splits the output tensor along its first axis and rebuilds
+// one NIfTI volume per input using the input geometry
+func (b *KServeBackend) writeOutputs(inputs []*Volume, output *kserveOutput) ([]string, error) {
+	datatype, ok := kserveDatatypes[output.tensor.Datatype]
+	if !ok {
+		return nil, fmt.Errorf("unsupported output datatype: %s", output.tensor.Datatype)
+	}
+
+	elements := 1
+	for _, d := range output.tensor.Shape {
+		elements *= d
+	}
+	n := inputs[0].NumVoxels()
+	if elements != len(inputs)*n {
+		return nil, fmt.Errorf("output shape %v does not match %d inputs of dimensions %v", output.tensor.Shape, len(inputs), inputs[0].Dims)
+	}
+
+	size := n * datatype.Size()
+	if output.raw != nil {
+		if len(output.raw) != len(inputs)*size {
+			return nil, fmt.Errorf("binary output has %d bytes, expected %d", len(output.raw), len(inputs)*size)
+		}
+	} else if len(output.tensor.Data) != len(inputs)*n {
+		return nil, fmt.Errorf("output has %d values, expected %d", len(output.tensor.Data), len(inputs)*n)
+	}
+
+	outputPaths := make([]string, 0, len(inputs))
+	for i, input := range inputs {
+		volume := &Volume{
+			Dims:     append([]int(nil), input.Dims...),
+			Datatype: datatype,
+			Affine:   input.Affine,
+		}
+		if output.raw != nil {
+			volume.Data = output.raw[i*size : (i+1)*size]
+		} else {
+			volume.Data = encodeSamples(output.tensor.Data[i*n:(i+1)*n], datatype)
+		}
+
+		outputPath := filepath.Join("/tmp", fmt.Sprintf("%s_output.nii", uuid.New().String()))
+		if err := WriteNifti(outputPath, volume); err != nil {
+			os.Remove(outputPath)
+			for _, path := range outputPaths {
+				os.Remove(path)
+			}
+			return nil, err
+		}
+		outputPaths = append(outputPaths, outputPath)
+	}
+
+	return outputPaths, nil
+}
+
+// encodeSamples converts values to little-endian samples of a datatype
+func encodeSamples(values []float64, datatype Datatype) []byte {
+	size := datatype.Size()
+	data := make([]byte, len(values)*size)
+	for i, value := range values {
+		b := data[i*size:]
+		switch datatype {
+		case Uint8:
+			b[0] = uint8(value)
+		case Int8:
+			b[0] = byte(int8(value))
+		case Uint16:
+			binary.LittleEndian.PutUint16(b, uint16(value))
+		case Int16:
+			binary.LittleEndian.PutUint16(b, uint16(int16(value)))
+		case Uint32:
+			binary.LittleEndian.PutUint32(b, uint32(value))
+		case Int32:
+			binary.LittleEndian.PutUint32(b, uint32(int32(value)))
+		case Uint64:
+			binary.LittleEndian.PutUint64(b, uint64(value))
+		case Int64:
+			binary.LittleEndian.PutUint64(b, uint64(int64(value)))
+		case Float32:
+			binary.LittleEndian.PutUint32(b, math.Float32bits(float32(value)))
+		case Float64:
+			binary.LittleEndian.PutUint64(b, math.Float64bits(value))
+		}
+	}
+	return data
+}
+
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
@@ -0,0 +1,198 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeKServe stands in for a KServe server. It decodes the request in
+// either encoding and replies with the output built by respond.
+func fakeKServe(t *testing.T, respond func(w http.ResponseWriter, request kserveRequest, raw []byte)) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/models/seg/infer" {
+			t.Errorf("path = %q, want /v2/models/seg/infer", r.URL.Path)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read request: %v", err)
+			return
+		}
+
+		header, raw := body, []byte(nil)
+		if value := r.Header.Get("Inference-Header-Content-Length"); value != "" {
+			length, err := strconv.Atoi(value)
+			if err != nil || length > len(body) {
+				t.Errorf("invalid Inference-Header-Content-Length %q", value)
+				return
+			}
+			header, raw = body[:length], body[length:]
+		}
+
+		var request kserveRequest
+		if err := json.Unmarshal(header, &request); err != nil {
+			t.Errorf("decode request: %v", err)
+			return
+		}
+		respond(w, request, raw)
+	}))
+}
+
+func newTestKServeBackend(url string, binary bool) *KServeBackend {
+	backend := NewKServeBackend(url, "seg", "", time.Minute)
+	backend.binary = binary
+	return backend
+}
+
+func TestKServeBackendJSON(t *testing.T) {
+	inputPath, input := writeTestNifti(t)
+
+	server := fakeKServe(t, func(w http.ResponseWriter, request kserveRequest, raw []byte) {
+		tensor := request.Inputs[0]
+		if want := []int{1, 2, 3, 4}; !slices.Equal(tensor.Shape, want) {
+			t.Errorf("input shape = %v, want %v", tensor.Shape, want)
+		}
+		if tensor.Datatype != "FP32" || raw != nil {
+			t.Errorf("input is not a JSON FP32 tensor")
+		}
+
+		// Label every voxel by the parity of its input value
+		labels := make([]float64, len(tensor.Data))
+		for i, value := range tensor.Data {
+			labels[i] = float64(int(value) % 2)
+		}
+		json.NewEncoder(w).Encode(kserveResponse{
+			ModelName: "seg",
+			Outputs:   []kserveTensor{{Name: "labels", Shape: tensor.Shape, Datatype: "UINT8", Data: labels}},
+		})
+	})
+	defer server.Close()
+
+	outputPath, err := newTestKServeBackend(server.URL, false).Infer(context.Background(), inputPath)
+	if err != nil {
+		t.Fatalf("Infer: %v", err)
+	}
+
+	output := readTestOutput(t, outputPath)
+	if output.Datatype != Uint8 {
+		t.Errorf("datatype = %s, want uint8", output.Datatype)
+	}
+	if output.Affine != input.Affine {
+		t.Errorf("affine = %v, want %v", output.Affine, input.Affine)
+	}
+	for i := 0; i < input.NumVoxels(); i++ {
+		if got, want := output.Value(i), float64(i%2); got != want {
+			t.Fatalf("voxel %d = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestKServeBackendBinary(t *testing.T) {
+	inputPath, input := writeTestNifti(t)
+
+	server := fakeKServe(t, func(w http.ResponseWriter, request kserveRequest, raw []byte) {
+		if request.Parameters["binary_data_output"] != true {
+			t.Errorf("binary output was not requested")
+		}
+		if !bytes.Equal(raw, input.Data) {
+			t.Errorf("binary input differs from the volume data")
+		}
+
+		// Return the input unchanged as the binary output
+		header, _ := json.Marshal(kserveResponse{
+			Outputs: []kserveTensor{{
+				Name:       "output",
+				Shape:      request.Inputs[0].Shape,
+				Datatype:   "FP32",
+				Parameters: map[string]any{"binary_data_size": len(raw)},
+			}},
+		})
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Inference-Header-Content-Length", strconv.Itoa(len(header)))
+		w.Write(header)
+		w.Write(raw)
+	})
+	defer server.Close()
+
+	outputPath, err := newTestKServeBackend(server.URL, true).Infer(context.Background(), inputPath)
+	if err != nil {
+		t.Fatalf("Infer: %v", err)
+	}
+
+	output := readTestOutput(t, outputPath)
+	if output.Datatype != Float32 || !bytes.Equal(output.Data, input.Data) {
+		t.Errorf("output differs from input")
+	}
+}
+
+func TestKServeBackendErrors(t *testing.T) {
+	inputPath, input := writeTestNifti(t)
+	n := input.NumVoxels()
+
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter)
+		want    string
+	}{
+		{
+			name: "shape mismatch",
+			respond: func(w http.ResponseWriter) {
+				json.NewEncoder(w).Encode(kserveResponse{
+					Outputs: []kserveTensor{{Name: "output", Shape: []int{1, n - 1}, Datatype: "FP32", Data: make([]float64, n-1)}},
+				})
+			},
+			want: "does not match",
+		},
+		{
+			name: "error status",
+			respond: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(kserveResponse{Error: "model failed to load"})
+			},
+			want: "model returned error 500: model failed to load",
+		},
+		{
+			name: "error without json",
+			respond: func(w http.ResponseWriter) {
+				http.Error(w, "bad gateway", http.StatusBadGateway)
+			},
+			want: "model returned error 502: bad gateway",
+		},
+		{
+			name: "oversized response",
+			respond: func(w http.ResponseWriter) {
+				w.Write(bytes.Repeat([]byte(" "), 2*kserveResponseMargin))
+			},
+			want: "model response exceeds",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakeKServe(t, func(w http.ResponseWriter, request kserveRequest, raw []byte) {
+				tt.respond(w)
+			})
+			defer server.Close()
+
+			outputPath, err := newTestKServeBackend(server.URL, false).Infer(context.Background(), inputPath)
+			if err == nil {
+				os.Remove(outputPath)
+				t.Fatalf("Infer succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
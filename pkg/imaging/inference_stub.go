@@ -0,0 +1,45 @@
+package imaging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// StubBackend returns a copy of the input volume. It lets the pipeline run
+// locally and in tests without a model server.
+type StubBackend struct{}
+
+func NewStubBackend() *StubBackend {
+	return &StubBackend{}
+}
+
+func (b *StubBackend) Name() string {
+	return "stub"
+}
+
+func (b *StubBackend) Infer(ctx context.Context, inputNiiPath string) (string, error) {
+	input, err := os.Open(inputNiiPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer input.Close()
+
+	outputPath := filepath.Join("/tmp", fmt.Sprintf("%s_output.nii", uuid.New().String()))
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer output.Close()
+
+	if _, err := io.Copy(output, input); err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("failed to copy input file: %w", err)
+	}
+
+	return outputPath, nil
+}
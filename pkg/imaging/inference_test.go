@@ -0,0 +1,147 @@
+package imaging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestNifti writes a small float32 volume with a non-identity affine
+// and returns its path
+func writeTestNifti(t *testing.T) (string, *Volume) {
+	t.Helper()
+
+	volume := &Volume{
+		Dims:     []int{4, 3, 2},
+		Datatype: Float32,
+		Affine:   [4][4]float64{{2, 0, 0, -10}, {0, 2, 0, -20}, {0, 0, 3, 5}, {0, 0, 0, 1}},
+	}
+	for i := 0; i < volume.NumVoxels(); i++ {
+		volume.Data = binary.LittleEndian.AppendUint32(volume.Data, math.Float32bits(float32(i)))
+	}
+
+	path := filepath.Join(t.TempDir(), "input.nii")
+	if err := WriteNifti(path, volume); err != nil {
+		t.Fatalf("WriteNifti: %v", err)
+	}
+	return path, volume
+}
+
+// readTestOutput reads an output volume and removes its file
+func readTestOutput(t *testing.T, path string) *Volume {
+	t.Helper()
+	defer os.Remove(path)
+
+	volume, err := ReadNifti(path)
+	if err != nil {
+		t.Fatalf("ReadNifti: %v", err)
+	}
+	return volume
+}
+
+func TestStubBackendCopiesInput(t *testing.T) {
+	inputPath, input := writeTestNifti(t)
+
+	outputPath, err := NewStubBackend().Infer(context.Background(), inputPath)
+	if err != nil {
+		t.Fatalf("Infer: %v", err)
+	}
+	if outputPath == inputPath {
+		t.Fatalf("output path is the input path")
+	}
+
+	output := readTestOutput(t, outputPath)
+	if !bytes.Equal(output.Data, input.Data) {
+		t.Errorf("output data differs from input")
+	}
+	if output.Affine != input.Affine {
+		t.Errorf("affine = %v, want %v", output.Affine, input.Affine)
+	}
+}
+
+func TestHTTPBackendInfer(t *testing.T) {
+	inputPath, input := writeTestNifti(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Api-Key"); got != "secret" {
+			t.Errorf("auth header = %q, want %q", got, "secret")
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("FormFile: %v", err)
+			http.Error(w, "no file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		if header.Filename != "input.nii" {
+			t.Errorf("filename = %q, want input.nii", header.Filename)
+		}
+
+		// Echo the input back gzip compressed
+		w.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(w)
+		io.Copy(gz, file)
+		gz.Close()
+	}))
+	defer server.Close()
+
+	backend := NewHTTPBackend(server.URL, time.Minute, "X-Api-Key", "secret")
+	outputPath, err := backend.Infer(context.Background(), inputPath)
+	if err != nil {
+		t.Fatalf("Infer: %v", err)
+	}
+
+	output := readTestOutput(t, outputPath)
+	if !bytes.Equal(output.Data, input.Data) {
+		t.Errorf("output data differs from input")
+	}
+}
+
+func TestHTTPBackendErrors(t *testing.T) {
+	inputPath, _ := writeTestNifti(t)
+
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		want        string
+	}{
+		{"error status", http.StatusInternalServerError, "text/plain", "out of memory", "model returned error 500: out of memory"},
+		{"json body", http.StatusOK, "application/json", `{"status":"ok"}`, "instead of a NIfTI file"},
+		{"empty body", http.StatusOK, "application/octet-stream", "", "empty response"},
+		{"invalid nifti", http.StatusOK, "application/octet-stream", "not a volume", "invalid NIfTI file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer server.Close()
+
+			backend := NewHTTPBackend(server.URL, time.Minute, "Authorization", "")
+			outputPath, err := backend.Infer(context.Background(), inputPath)
+			if err == nil {
+				os.Remove(outputPath)
+				t.Fatalf("Infer succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package imaging
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Metadata describes an uploaded image or volume
+type Metadata struct {
+	Format      string    `json:"format"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Depth       int       `json:"depth"`
+	BitDepth    int       `json:"bit_depth"`
+	ColorMode   string    `json:"color_mode"`
+	FileSize    int64     `json:"file_size"`
+	SHA256      string    `json:"sha256"`
+	Spacing     []float64 `json:"spacing,omitempty"`
+	Orientation string    `json:"orientation,omitempty"`
+	Modality    string    `json:"modality,omitempty"`
+}
+
+// ExtractMetadata reads dimensions, depth, size and checksum of a file.
+// JPEG, PNG, NRRD and MetaImage headers are decoded directly, other
+// formats are inspected with the Python converter script.
+func ExtractMetadata(filePath string) (*Metadata, error) {
+	size, checksum, err := fileChecksum(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta *Metadata
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".jpg", ".jpeg", ".png":
+		meta, err = rasterMetadata(filePath)
+	case ".nrrd", ".mha":
+		meta, err = volumeHeaderMetadata(filePath)
+	default:
+		meta, err = volumeMetadata(filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta.FileSize = size
+	meta.SHA256 = checksum
+	return meta, nil
+}
+
+func fileChecksum(filePath string) (int64, string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to hash file: %w", err)
+	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func rasterMetadata(filePath string) (*Metadata, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	return decodeRasterMetadata(file)
+}
+
+// decodeRasterMetadata reads the dimensions and color model of a JPEG or
+// PNG image from its header
+func decodeRasterMetadata(r io.Reader) (*Metadata, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image header: %w", err)
+	}
+
+	colorMode, bitDepth := describeColorModel(config.ColorModel)
+
+	return &Metadata{
+		Format:    format,
+		Width:     config.Width,
+		Height:    config.Height,
+		Depth:     1,
+		BitDepth:  bitDepth,
+		ColorMode: colorMode,
+	}, nil
+}
+
+// describeColorModel returns a color mode name and bits per channel
+func describeColorModel(model color.Model) (string, int) {
+	switch model {
+	case color.GrayModel:
+		return "gray", 8
+	case color.Gray16Model:
+		return "gray", 16
+	case color.RGBAModel, color.NRGBAModel:
+		return "rgba", 8
+	case color.RGBA64Model, color.NRGBA64Model:
+		return "rgba", 16
+	case color.YCbCrModel:
+		return "ycbcr", 8
+	case color.CMYKModel:
+		return "cmyk", 8
+	}
+
+	if _, ok := model.(color.Palette); ok {
+		return "palette", 8
+	}
+
+	return "unknown", 0
+}
+
+func volumeHeaderMetadata(filePath string) (*Metadata, error) {
+	volume, err := readVolumeHeader(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return describeVolume(volume, filepath.Ext(filePath)), nil
+}
+
+// describeVolume builds the metadata of a NRRD or MetaImage volume header
+func describeVolume(volume *Volume, ext string) *Metadata {
+	format := "nrrd"
+	if ext = strings.ToLower(ext); ext == ".mha" {
+		format = "metaimage"
+	}
+
+	dims := volume.dims3()
+	return &Metadata{
+		Format:      format,
+		Width:       dims[0],
+		Height:      dims[1],
+		Depth:       dims[2],
+		BitDepth:    volume.Datatype.Size() * 8,
+		ColorMode:   volume.Datatype.String(),
+		Spacing:     volume.Spacing()[:len(volume.Dims)],
+		Orientation: volume.Orientation(),
+	}
+}
+
+func volumeMetadata(filePath string) (*Metadata, error) {
+	cmd := converterCommand(filePath, "--info")
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("metadata extraction failed: %s - %s", err.Error(), stderr.String())
+	}
+
+	var meta Metadata
+	if err := json.Unmarshal(stdout.Bytes(), &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata output: %w", err)
+	}
+
+	return &meta, nil
+}
@@ -0,0 +1,344 @@
+package imaging
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var metaImageTypes = map[string]Datatype{
+	"MET_UCHAR":      Uint8,
+	"MET_CHAR":       Int8,
+	"MET_USHORT":     Uint16,
+	"MET_SHORT":      Int16,
+	"MET_UINT":       Uint32,
+	"MET_INT":        Int32,
+	"MET_ULONG_LONG": Uint64,
+	"MET_LONG_LONG":  Int64,
+	"MET_FLOAT":      Float32,
+	"MET_DOUBLE":     Float64,
+}
+
+// ReadMetaImage reads a MetaImage volume with local data (.mha). Uploads of
+// a .mhd header with its data file are joined into one with
+// InlineMetaImageHeader. Coordinates are converted from ITK's LPS
+// convention to RAS.
+func ReadMetaImage(path string) (*Volume, error) {
+	return readMetaImage(path, false)
+}
+
+func readMetaImage(path string, headerOnly bool) (*Volume, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open MetaImage file: %w", err)
+	}
+	defer file.Close()
+
+	return decodeMetaImage(bufio.NewReader(file), headerOnly)
+}
+
+// decodeMetaImage reads a MetaImage header, and unless headerOnly the
+// local data following it
+func decodeMetaImage(r *bufio.Reader, headerOnly bool) (*Volume, error) {
+	fields := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("MetaImage header has no ElementDataFile")
+		}
+		key, value, ok := strings.Cut(strings.TrimRight(line, "\r\n"), "=")
+		if !ok {
+			return nil, fmt.Errorf("not a MetaImage file")
+		}
+		key = strings.TrimSpace(key)
+		fields[key] = strings.TrimSpace(value)
+		// ElementDataFile is always the last header field
+		if key == "ElementDataFile" {
+			break
+		}
+	}
+
+	if fields["ElementDataFile"] != "LOCAL" {
+		return nil, fmt.Errorf("MetaImage files with a separate data file are not supported, use .mha")
+	}
+	if channels := fields["ElementNumberOfChannels"]; channels != "" && channels != "1" {
+		return nil, fmt.Errorf("multi-channel MetaImage files are not supported")
+	}
+
+	datatype, ok := metaImageTypes[fields["ElementType"]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported MetaImage element type: %q", fields["ElementType"])
+	}
+
+	dims, err := parseInts(fields["DimSize"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid MetaImage DimSize: %w", err)
+	}
+	if ndims := fields["NDims"]; ndims != strconv.Itoa(len(dims)) {
+		return nil, fmt.Errorf("MetaImage NDims %s does not match DimSize %v", ndims, dims)
+	}
+
+	// The affine is built for at most three axes, check them first
+	v := &Volume{
+		Dims:     dims,
+		Datatype: datatype,
+	}
+	if err := v.validate(); err != nil {
+		return nil, err
+	}
+	if v.Affine, err = metaImageAffine(fields, len(dims)); err != nil {
+		return nil, err
+	}
+
+	if headerOnly {
+		return v, nil
+	}
+
+	var data io.Reader = r
+	if strings.EqualFold(fields["CompressedData"], "True") {
+		zr, err := zlib.NewReader(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open zlib stream: %w", err)
+		}
+		defer zr.Close()
+		data = zr
+	}
+
+	if v.Data, err = readVolumeData(data, v.NumVoxels()*datatype.Size()); err != nil {
+		return nil, fmt.Errorf("failed to read MetaImage data: %w", err)
+	}
+
+	msb := fields["BinaryDataByteOrderMSB"]
+	if msb == "" {
+		msb = fields["ElementByteOrderMSB"]
+	}
+	if strings.EqualFold(msb, "True") {
+		swapBytes(v.Data, datatype.Size())
+	}
+
+	return v, nil
+}
+
+// metaImageAffine builds a RAS affine from spacing, direction and offset
+func metaImageAffine(fields map[string]string, ndim int) ([4][4]float64, error) {
+	affine := identityAffine()
+	lpsToRAS := [3]float64{-1, -1, 1}
+
+	spacing := []float64{1, 1, 1}
+	spacingField := fields["ElementSpacing"]
+	if spacingField == "" {
+		spacingField = fields["ElementSize"]
+	}
+	if spacingField != "" {
+		values, err := parseFloats(spacingField)
+		if err != nil || len(values) != ndim {
+			return affine, fmt.Errorf("invalid MetaImage ElementSpacing: %q", spacingField)
+		}
+		copy(spacing, values)
+	}
+
+	// TransformMatrix lists the direction of each axis in turn
+	direction := []float64{1, 0, 0, 0, 1, 0, 0, 0, 1}
+	for _, key := range []string{"TransformMatrix", "Rotation", "Orientation"} {
+		if field := fields[key]; field != "" {
+			values, err := parseFloats(field)
+			if err != nil || len(values) != ndim*ndim {
+				return affine, fmt.Errorf("invalid MetaImage %s: %q", key, field)
+			}
+			direction = make([]float64, 9)
+			for axis := 0; axis < ndim; axis++ {
+				copy(direction[axis*3:axis*3+ndim], values[axis*ndim:(axis+1)*ndim])
+			}
+			if ndim == 2 {
+				direction[8] = 1
+			}
+			break
+		}
+	}
+
+	offset := []float64{0, 0, 0}
+	for _, key := range []string{"Offset", "Position", "Origin"} {
+		if field := fields[key]; field != "" {
+			values, err := parseFloats(field)
+			if err != nil || len(values) != ndim {
+				return affine, fmt.Errorf("invalid MetaImage %s: %q", key, field)
+			}
+			copy(offset, values)
+			break
+		}
+	}
+
+	for world := 0; world < 3; world++ {
+		for axis := 0; axis < 3; axis++ {
+			affine[world][axis] = direction[axis*3+world] * spacing[axis] * lpsToRAS[world]
+		}
+		affine[world][3] = offset[world] * lpsToRAS[world]
+	}
+
+	return affine, nil
+}
+
+// WriteMetaImage writes a volume as an uncompressed .mha file in LPS space
+func WriteMetaImage(path string, v *Volume) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create MetaImage file: %w", err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	writeMetaImageHeader(w, v, "LOCAL")
+	if _, err := w.Write(v.Data); err != nil {
+		return fmt.Errorf("failed to write MetaImage data: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write MetaImage file: %w", err)
+	}
+
+	return nil
+}
+
+// WriteMetaImageArchive writes a volume as a zip archive of a .mhd header
+// and its .raw data file, both named after name
+func WriteMetaImageArchive(path string, v *Volume, name string) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create MetaImage archive: %w", err)
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	header, err := archive.Create(name + ".mhd")
+	if err != nil {
+		return fmt.Errorf("failed to write MetaImage archive: %w", err)
+	}
+	w := bufio.NewWriter(header)
+	writeMetaImageHeader(w, v, name+".raw")
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write MetaImage header: %w", err)
+	}
+
+	data, err := archive.Create(name + ".raw")
+	if err != nil {
+		return fmt.Errorf("failed to write MetaImage archive: %w", err)
+	}
+	if _, err := data.Write(v.Data); err != nil {
+		return fmt.Errorf("failed to write MetaImage data: %w", err)
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to write MetaImage archive: %w", err)
+	}
+
+	return nil
+}
+
+// writeMetaImageHeader writes the header of a volume in LPS space with its
+// data in dataFile, or following the header for LOCAL
+func writeMetaImageHeader(w *bufio.Writer, v *Volume, dataFile string) {
+	var elementType string
+	for name, dt := range metaImageTypes {
+		if dt == v.Datatype {
+			elementType = name
+		}
+	}
+
+	ndim := len(v.Dims)
+	lpsToRAS := [3]float64{-1, -1, 1}
+	spacing := v.Spacing()
+
+	direction := make([]float64, 0, ndim*ndim)
+	offset := make([]float64, 0, ndim)
+	for axis := 0; axis < ndim; axis++ {
+		for world := 0; world < ndim; world++ {
+			value := 0.0
+			if spacing[axis] > 0 {
+				value = v.Affine[world][axis] * lpsToRAS[world] / spacing[axis]
+			}
+			direction = append(direction, value)
+		}
+		offset = append(offset, v.Affine[axis][3]*lpsToRAS[axis])
+	}
+
+	fmt.Fprintf(w, "ObjectType = Image\n")
+	fmt.Fprintf(w, "NDims = %d\n", ndim)
+	fmt.Fprintf(w, "BinaryData = True\n")
+	fmt.Fprintf(w, "BinaryDataByteOrderMSB = False\n")
+	fmt.Fprintf(w, "CompressedData = False\n")
+	fmt.Fprintf(w, "TransformMatrix = %s\n", formatFloats(direction))
+	fmt.Fprintf(w, "Offset = %s\n", formatFloats(offset))
+	fmt.Fprintf(w, "ElementSpacing = %s\n", formatFloats(spacing[:ndim]))
+	fmt.Fprintf(w, "DimSize = %s\n", formatInts(v.Dims))
+	fmt.Fprintf(w, "ElementType = %s\n", elementType)
+	fmt.Fprintf(w, "ElementDataFile = %s\n", dataFile)
+}
+
+// InlineMetaImageHeader turns the header of a .mhd file into the header of
+// a .mha file, so that the content of its data file can follow it. The
+// header must name dataFile as its only data file.
+func InlineMetaImageHeader(header []byte, dataFile string) ([]byte, error) {
+	lines := strings.Split(strings.TrimRight(string(header), "\r\n"), "\n")
+	last := strings.TrimRight(lines[len(lines)-1], "\r")
+
+	// ElementDataFile is always the last header field
+	key, value, ok := strings.Cut(last, "=")
+	if !ok || strings.TrimSpace(key) != "ElementDataFile" {
+		return nil, fmt.Errorf("MetaImage header does not end with ElementDataFile")
+	}
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "LOCAL":
+		return nil, fmt.Errorf("MetaImage header has local data, upload it as .mha")
+	case value == "LIST" || strings.ContainsAny(value, " %"):
+		return nil, fmt.Errorf("MetaImage file lists are not supported")
+	case path.Base(strings.ReplaceAll(value, "\\", "/")) != path.Base(dataFile):
+		return nil, fmt.Errorf("MetaImage header names data file %q, got %q", value, dataFile)
+	}
+
+	for _, line := range lines[:len(lines)-1] {
+		key, value, _ := strings.Cut(line, "=")
+		if strings.TrimSpace(key) == "HeaderSize" && strings.TrimSpace(value) != "0" {
+			return nil, fmt.Errorf("MetaImage data files with a header are not supported")
+		}
+	}
+
+	lines[len(lines)-1] = "ElementDataFile = LOCAL"
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+func parseFloats(s string) ([]float64, error) {
+	fields := strings.Fields(s)
+	values := make([]float64, len(fields))
+	for i, field := range fields {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func formatFloats(values []float64) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		if value == 0 {
+			value = 0 // avoid printing negative zero
+		}
+		parts[i] = strconv.FormatFloat(value, 'g', -1, 64)
+	}
+	return strings.Join(parts, " ")
+}
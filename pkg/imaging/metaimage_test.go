@@ -0,0 +1,208 @@
+package imaging
+
+import (
+	"archive/zip"
+	"bufio"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func decodeMetaImageString(s string, headerOnly bool) (*Volume, error) {
+	return decodeMetaImage(bufio.NewReader(strings.NewReader(s)), headerOnly)
+}
+
+func TestMetaImageRoundTrip(t *testing.T) {
+	volume := &Volume{
+		Dims:     []int{2, 3, 2},
+		Datatype: Float32,
+		Affine:   [4][4]float64{{-1, 0, 0, 5}, {0, 0, 2, -4}, {0, -1.5, 0, 3}, {0, 0, 0, 1}},
+		Data:     encodeSamples([]float64{0, 0.5, 1, 1.5, 2, 2.5, 3, 3.5, 4, 4.5, 5, 5.5}, Float32),
+	}
+
+	path := filepath.Join(t.TempDir(), "volume.mha")
+	if err := WriteMetaImage(path, volume); err != nil {
+		t.Fatalf("WriteMetaImage: %v", err)
+	}
+	read, err := ReadMetaImage(path)
+	if err != nil {
+		t.Fatalf("ReadMetaImage: %v", err)
+	}
+
+	if !equalInts(read.Dims, volume.Dims) || read.Datatype != volume.Datatype {
+		t.Errorf("read %v %s, want %v %s", read.Dims, read.Datatype, volume.Dims, volume.Datatype)
+	}
+	if read.Affine != volume.Affine {
+		t.Errorf("affine = %v, want %v", read.Affine, volume.Affine)
+	}
+	if string(read.Data) != string(volume.Data) {
+		t.Errorf("data differs after round trip")
+	}
+}
+
+func TestMetaImageHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{
+			name:   "not metaimage",
+			header: "NRRD0004\n",
+			want:   "not a MetaImage file",
+		},
+		{
+			name:   "no data file",
+			header: "ObjectType = Image\nNDims = 1\n",
+			want:   "no ElementDataFile",
+		},
+		{
+			name:   "separate data file",
+			header: "NDims = 1\nDimSize = 4\nElementType = MET_UCHAR\nElementDataFile = volume.raw\n",
+			want:   "separate data file",
+		},
+		{
+			name:   "unknown element type",
+			header: "NDims = 1\nDimSize = 4\nElementType = MET_STRING\nElementDataFile = LOCAL\n",
+			want:   "unsupported MetaImage element type",
+		},
+		{
+			name:   "ndims mismatch",
+			header: "NDims = 3\nDimSize = 4 4\nElementType = MET_UCHAR\nElementDataFile = LOCAL\n",
+			want:   "does not match DimSize",
+		},
+		{
+			name:   "four dimensions",
+			header: "NDims = 4\nDimSize = 2 2 2 2\nTransformMatrix = 1 0 0 0 0 1 0 0 0 0 1 0 0 0 0 1\nElementType = MET_UCHAR\nElementDataFile = LOCAL\n",
+			want:   "unsupported number of dimensions: 4",
+		},
+		{
+			name:   "oversized axis",
+			header: "NDims = 3\nDimSize = 2 70000 2\nElementType = MET_UCHAR\nElementDataFile = LOCAL\n",
+			want:   "invalid dimension size: 70000",
+		},
+		{
+			name:   "oversized volume",
+			header: "NDims = 3\nDimSize = 65536 65536 2\nElementType = MET_DOUBLE\nElementDataFile = LOCAL\n",
+			want:   "the limit is",
+		},
+		{
+			name:   "short transform",
+			header: "NDims = 3\nDimSize = 2 2 2\nTransformMatrix = 1 0 0 0 1 0\nElementType = MET_UCHAR\nElementDataFile = LOCAL\n",
+			want:   "invalid MetaImage TransformMatrix",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeMetaImageString(tt.header, true)
+			if err == nil {
+				t.Fatalf("decodeMetaImage succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetaImageTruncatedData(t *testing.T) {
+	header := "NDims = 3\nDimSize = 4 4 4\nElementType = MET_UCHAR\nElementDataFile = LOCAL\n"
+	_, err := decodeMetaImageString(header+strings.Repeat("x", 10), false)
+	if err == nil || !strings.Contains(err.Error(), "got 10 of 64 bytes") {
+		t.Errorf("error = %v, want a short read of 10 of 64 bytes", err)
+	}
+}
+
+func TestMetaImageArchiveRoundTrip(t *testing.T) {
+	volume := &Volume{
+		Dims:     []int{3, 2, 2},
+		Datatype: Uint8,
+		Affine:   [4][4]float64{{-0.5, 0, 0, 1}, {0, -0.5, 0, 2}, {0, 0, 1, 3}, {0, 0, 0, 1}},
+		Data:     []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	}
+
+	path := filepath.Join(t.TempDir(), "result.zip")
+	if err := WriteMetaImageArchive(path, volume, "result"); err != nil {
+		t.Fatalf("WriteMetaImageArchive: %v", err)
+	}
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	defer archive.Close()
+
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatalf("open %s: %v", file.Name, err)
+		}
+		files[file.Name], _ = io.ReadAll(r)
+		r.Close()
+	}
+	if len(files) != 2 || files["result.mhd"] == nil || files["result.raw"] == nil {
+		t.Fatalf("archive holds %d files, want result.mhd and result.raw", len(files))
+	}
+
+	// Join the files the way an upload of both does
+	header, err := InlineMetaImageHeader(files["result.mhd"], "result.raw")
+	if err != nil {
+		t.Fatalf("InlineMetaImageHeader: %v", err)
+	}
+	read, err := decodeMetaImageString(string(header)+string(files["result.raw"]), false)
+	if err != nil {
+		t.Fatalf("decodeMetaImage: %v", err)
+	}
+	if !equalInts(read.Dims, volume.Dims) || read.Affine != volume.Affine || string(read.Data) != string(volume.Data) {
+		t.Errorf("volume differs after round trip")
+	}
+}
+
+func TestInlineMetaImageHeaderErrors(t *testing.T) {
+	const fields = "NDims = 1\nDimSize = 4\nElementType = MET_UCHAR\n"
+
+	tests := []struct {
+		name     string
+		header   string
+		dataFile string
+		want     string
+	}{
+		{"no data file", "NDims = 1\nDimSize = 4\n", "volume.raw", "does not end with ElementDataFile"},
+		{"local data", fields + "ElementDataFile = LOCAL\n", "volume.raw", "upload it as .mha"},
+		{"file list", fields + "ElementDataFile = LIST\n", "volume.raw", "file lists are not supported"},
+		{"file pattern", fields + "ElementDataFile = slice%03d.raw 1 4 1\n", "volume.raw", "file lists are not supported"},
+		{"other data file", fields + "ElementDataFile = other.raw\n", "volume.raw", `names data file "other.raw"`},
+		{"data file header", "HeaderSize = 512\n" + fields + "ElementDataFile = volume.raw\n", "volume.raw", "data files with a header"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := InlineMetaImageHeader([]byte(tt.header), tt.dataFile)
+			if err == nil {
+				t.Fatalf("InlineMetaImageHeader succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestInlineMetaImageHeaderKeepsFields(t *testing.T) {
+	header := "NDims = 1\r\nDimSize = 4\r\nElementType = MET_UCHAR\r\nElementDataFile = data/volume.raw\r\n"
+	inlined, err := InlineMetaImageHeader([]byte(header), "volume.raw")
+	if err != nil {
+		t.Fatalf("InlineMetaImageHeader: %v", err)
+	}
+
+	volume, err := decodeMetaImageString(string(inlined)+"\x01\x02\x03\x04", false)
+	if err != nil {
+		t.Fatalf("decodeMetaImage: %v", err)
+	}
+	if string(volume.Data) != "\x01\x02\x03\x04" {
+		t.Errorf("data = %v, want 1 2 3 4", volume.Data)
+	}
+}
@@ -0,0 +1,327 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+const (
+	niftiHeaderSize = 348
+	niftiVoxOffset  = 352
+)
+
+var niftiDatatypes = map[int16]Datatype{
+	2:    Uint8,
+	4:    Int16,
+	8:    Int32,
+	16:   Float32,
+	64:   Float64,
+	256:  Int8,
+	512:  Uint16,
+	768:  Uint32,
+	1024: Int64,
+	1280: Uint64,
+}
+
+// ReadNifti reads a single-file NIfTI-1 volume (.nii or .nii.gz).
+// Scaled data is converted to float32 with the slope and intercept applied.
+func ReadNifti(path string) (*Volume, error) {
+	return readNifti(path, false)
+}
+
+func readNifti(path string, headerOnly bool) (*Volume, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open NIfTI file: %w", err)
+	}
+	defer file.Close()
+
+	r, err := decompressNifti(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return DecodeNifti(r, headerOnly)
+}
+
+// decompressNifti returns a reader of the uncompressed stream, detecting
+// gzip by its magic bytes
+func decompressNifti(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		return gz, nil
+	}
+	return io.NopCloser(br), nil
+}
+
+// niftiLayout describes how voxel data follows a NIfTI header
+type niftiLayout struct {
+	order     binary.ByteOrder
+	voxOffset int64
+	slope     float64
+	inter     float64
+}
+
+// scaled reports whether voxel values need slope and intercept applied
+func (l niftiLayout) scaled() bool {
+	return l.slope != 0 && (l.slope != 1 || l.inter != 0)
+}
+
+// ReadNiftiHeader reads the geometry and datatype of a NIfTI file without
+// its voxel data
+func ReadNiftiHeader(path string) (*Volume, error) {
+	return readNifti(path, true)
+}
+
+// parseNiftiHeader parses a 348 byte NIfTI-1 header
+func parseNiftiHeader(hdr []byte) (*Volume, niftiLayout, error) {
+	var layout niftiLayout
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if order.Uint32(hdr[0:4]) != niftiHeaderSize {
+		order = binary.BigEndian
+		if order.Uint32(hdr[0:4]) != niftiHeaderSize {
+			return nil, layout, fmt.Errorf("not a NIfTI-1 file")
+		}
+	}
+
+	if !bytes.Equal(hdr[344:347], []byte("n+1")) {
+		return nil, layout, fmt.Errorf("only single-file NIfTI-1 volumes are supported")
+	}
+
+	int16At := func(offset int) int16 { return int16(order.Uint16(hdr[offset:])) }
+	float32At := func(offset int) float64 {
+		return float64(math.Float32frombits(order.Uint32(hdr[offset:])))
+	}
+
+	ndim := int(int16At(40))
+	if ndim < 1 || ndim > 7 {
+		return nil, layout, fmt.Errorf("invalid number of dimensions: %d", ndim)
+	}
+	dims := make([]int, ndim)
+	for i := range dims {
+		dims[i] = int(int16At(42 + 2*i))
+	}
+	// Trailing singleton axes (e.g. a single time point) carry no data
+	for len(dims) > 3 && dims[len(dims)-1] == 1 {
+		dims = dims[:len(dims)-1]
+	}
+
+	datatype, ok := niftiDatatypes[int16At(70)]
+	if !ok {
+		return nil, layout, fmt.Errorf("unsupported NIfTI datatype code: %d", int16At(70))
+	}
+
+	var pixdim [8]float64
+	for i := range pixdim {
+		pixdim[i] = float32At(76 + 4*i)
+	}
+
+	v := &Volume{
+		Dims:        dims,
+		Datatype:    datatype,
+		Affine:      niftiAffine(hdr, order, pixdim),
+		Description: string(bytes.TrimRight(hdr[148:228], "\x00")),
+	}
+	if err := v.validate(); err != nil {
+		return nil, layout, err
+	}
+
+	layout = niftiLayout{
+		order:     order,
+		voxOffset: int64(float32At(108)),
+		slope:     float32At(112),
+		inter:     float32At(116),
+	}
+	if layout.voxOffset < niftiHeaderSize {
+		layout.voxOffset = niftiHeaderSize
+	}
+
+	return v, layout, nil
+}
+
+// DecodeNifti decodes a NIfTI-1 volume from a reader. When headerOnly is
+// set the voxel data is not read.
+func DecodeNifti(r io.Reader, headerOnly bool) (*Volume, error) {
+	hdr := make([]byte, niftiHeaderSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("failed to read NIfTI header: %w", err)
+	}
+
+	v, layout, err := parseNiftiHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if headerOnly {
+		return v, nil
+	}
+
+	if layout.voxOffset > niftiHeaderSize {
+		if _, err := io.CopyN(io.Discard, r, layout.voxOffset-niftiHeaderSize); err != nil {
+			return nil, fmt.Errorf("failed to skip NIfTI extensions: %w", err)
+		}
+	}
+
+	if v.Data, err = readVolumeData(r, v.NumVoxels()*v.Datatype.Size()); err != nil {
+		return nil, fmt.Errorf("failed to read NIfTI data: %w", err)
+	}
+	if layout.order == binary.BigEndian {
+		swapBytes(v.Data, v.Datatype.Size())
+	}
+
+	if layout.scaled() {
+		v.rescale(layout.slope, layout.inter)
+	}
+
+	return v, nil
+}
+
+// niftiAffine builds the voxel to world matrix preferring sform over qform
+func niftiAffine(hdr []byte, order binary.ByteOrder, pixdim [8]float64) [4][4]float64 {
+	float32At := func(offset int) float64 {
+		return float64(math.Float32frombits(order.Uint32(hdr[offset:])))
+	}
+	qformCode := int16(order.Uint16(hdr[252:]))
+	sformCode := int16(order.Uint16(hdr[254:]))
+
+	affine := identityAffine()
+
+	if sformCode > 0 {
+		for row := 0; row < 3; row++ {
+			for col := 0; col < 4; col++ {
+				affine[row][col] = float32At(280 + 16*row + 4*col)
+			}
+		}
+		return affine
+	}
+
+	if qformCode > 0 {
+		b, c, d := float32At(256), float32At(260), float32At(264)
+		a := math.Sqrt(math.Max(0, 1-(b*b+c*c+d*d)))
+		rotation := [3][3]float64{
+			{a*a + b*b - c*c - d*d, 2 * (b*c - a*d), 2 * (b*d + a*c)},
+			{2 * (b*c + a*d), a*a + c*c - b*b - d*d, 2 * (c*d - a*b)},
+			{2 * (b*d - a*c), 2 * (c*d + a*b), a*a + d*d - b*b - c*c},
+		}
+		qfac := 1.0
+		if pixdim[0] < 0 {
+			qfac = -1
+		}
+		scale := [3]float64{pixdim[1], pixdim[2], pixdim[3] * qfac}
+		for row := 0; row < 3; row++ {
+			for col := 0; col < 3; col++ {
+				affine[row][col] = rotation[row][col] * scale[col]
+			}
+		}
+		affine[0][3], affine[1][3], affine[2][3] = float32At(268), float32At(272), float32At(276)
+		return affine
+	}
+
+	for axis := 0; axis < 3; axis++ {
+		if pixdim[axis+1] > 0 {
+			affine[axis][axis] = pixdim[axis+1]
+		}
+	}
+	return affine
+}
+
+// rescale applies slope and intercept and converts the data to float32
+func (v *Volume) rescale(slope float64, inter float64) {
+	n := v.NumVoxels()
+	data := make([]byte, n*4)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(float32(v.Value(i)*slope+inter)))
+	}
+	v.Datatype = Float32
+	v.Data = data
+}
+
+// WriteNifti writes a single-file NIfTI-1 volume, gzip compressed when
+// the path ends in .gz
+func WriteNifti(path string, v *Volume) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create NIfTI file: %w", err)
+	}
+	defer file.Close()
+
+	var w io.Writer = file
+	if strings.HasSuffix(strings.ToLower(path), ".gz") {
+		gz := gzip.NewWriter(file)
+		defer gz.Close()
+		w = gz
+	}
+
+	return EncodeNifti(w, v)
+}
+
+// EncodeNifti writes a NIfTI-1 header and the voxel data of a volume
+func EncodeNifti(w io.Writer, v *Volume) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+
+	var code int16
+	for c, dt := range niftiDatatypes {
+		if dt == v.Datatype {
+			code = c
+		}
+	}
+
+	hdr := make([]byte, niftiVoxOffset)
+	le := binary.LittleEndian
+	putFloat32 := func(offset int, value float64) {
+		le.PutUint32(hdr[offset:], math.Float32bits(float32(value)))
+	}
+
+	le.PutUint32(hdr[0:], niftiHeaderSize)
+	le.PutUint16(hdr[40:], uint16(len(v.Dims)))
+	for i := 0; i < 7; i++ {
+		size := 1
+		if i < len(v.Dims) {
+			size = v.Dims[i]
+		}
+		le.PutUint16(hdr[42+2*i:], uint16(size))
+	}
+	le.PutUint16(hdr[70:], uint16(code))
+	le.PutUint16(hdr[72:], uint16(v.Datatype.Size()*8))
+
+	spacing := v.Spacing()
+	putFloat32(76, 1) // qfac
+	for i, s := range spacing {
+		putFloat32(80+4*i, s)
+	}
+	putFloat32(108, niftiVoxOffset)
+	putFloat32(112, 1) // scl_slope
+	hdr[123] = 2       // xyzt_units: millimetres
+	copy(hdr[148:227], v.Description)
+
+	le.PutUint16(hdr[254:], 2) // sform_code: aligned anatomical
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 4; col++ {
+			putFloat32(280+16*row+4*col, v.Affine[row][col])
+		}
+	}
+	copy(hdr[344:], "n+1\x00")
+
+	if _, err := w.Write(hdr); err != nil {
+		return fmt.Errorf("failed to write NIfTI header: %w", err)
+	}
+	if _, err := w.Write(v.Data); err != nil {
+		return fmt.Errorf("failed to write NIfTI data: %w", err)
+	}
+	return nil
+}
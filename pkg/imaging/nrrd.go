@@ -0,0 +1,304 @@
+package imaging
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var nrrdTypes = map[string]Datatype{
+	"uchar": Uint8, "unsigned char": Uint8, "uint8": Uint8, "uint8_t": Uint8,
+	"signed char": Int8, "int8": Int8, "int8_t": Int8,
+	"short": Int16, "short int": Int16, "signed short": Int16, "signed short int": Int16, "int16": Int16, "int16_t": Int16,
+	"ushort": Uint16, "unsigned short": Uint16, "unsigned short int": Uint16, "uint16": Uint16, "uint16_t": Uint16,
+	"int": Int32, "signed int": Int32, "int32": Int32, "int32_t": Int32,
+	"uint": Uint32, "unsigned int": Uint32, "uint32": Uint32, "uint32_t": Uint32,
+	"longlong": Int64, "long long": Int64, "long long int": Int64, "signed long long": Int64, "signed long long int": Int64, "int64": Int64, "int64_t": Int64,
+	"ulonglong": Uint64, "unsigned long long": Uint64, "unsigned long long int": Uint64, "uint64": Uint64, "uint64_t": Uint64,
+	"float":  Float32,
+	"double": Float64,
+}
+
+var nrrdTypeNames = map[Datatype]string{
+	Uint8:   "uchar",
+	Int8:    "signed char",
+	Int16:   "short",
+	Uint16:  "ushort",
+	Int32:   "int",
+	Uint32:  "uint",
+	Int64:   "longlong",
+	Uint64:  "ulonglong",
+	Float32: "float",
+	Float64: "double",
+}
+
+// nrrdSpaceSigns flips world axes of a NRRD space into RAS
+var nrrdSpaceSigns = map[string][3]float64{
+	"right-anterior-superior": {1, 1, 1},
+	"ras":                     {1, 1, 1},
+	"left-anterior-superior":  {-1, 1, 1},
+	"las":                     {-1, 1, 1},
+	"left-posterior-superior": {-1, -1, 1},
+	"lps":                     {-1, -1, 1},
+}
+
+// ReadNrrd reads a NRRD volume with attached raw or gzip encoded data
+func ReadNrrd(path string) (*Volume, error) {
+	return readNrrd(path, false)
+}
+
+func readNrrd(path string, headerOnly bool) (*Volume, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open NRRD file: %w", err)
+	}
+	defer file.Close()
+
+	return decodeNrrd(bufio.NewReader(file), headerOnly)
+}
+
+// decodeNrrd reads a NRRD header, and the attached data unless headerOnly
+func decodeNrrd(r *bufio.Reader, headerOnly bool) (*Volume, error) {
+	magic, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(magic, "NRRD000") {
+		return nil, fmt.Errorf("not a NRRD file")
+	}
+
+	fields := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("unexpected end of NRRD header")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "#") || strings.Contains(line, ":=") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			return nil, fmt.Errorf("malformed NRRD header line: %q", line)
+		}
+		fields[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+
+	if _, ok := fields["data file"]; ok {
+		return nil, fmt.Errorf("detached NRRD data files are not supported")
+	}
+	if _, ok := fields["datafile"]; ok {
+		return nil, fmt.Errorf("detached NRRD data files are not supported")
+	}
+
+	datatype, ok := nrrdTypes[fields["type"]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported NRRD type: %q", fields["type"])
+	}
+
+	dims, err := parseInts(fields["sizes"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid NRRD sizes: %w", err)
+	}
+	if dimension := fields["dimension"]; dimension != strconv.Itoa(len(dims)) {
+		return nil, fmt.Errorf("NRRD dimension %s does not match sizes %v", dimension, dims)
+	}
+
+	// The affine is built for at most three axes, check them first
+	v := &Volume{
+		Dims:     dims,
+		Datatype: datatype,
+	}
+	if err := v.validate(); err != nil {
+		return nil, err
+	}
+	if v.Affine, err = nrrdAffine(fields, len(dims)); err != nil {
+		return nil, err
+	}
+
+	if headerOnly {
+		return v, nil
+	}
+
+	var data io.Reader = r
+	switch fields["encoding"] {
+	case "raw":
+	case "gzip", "gz":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		defer gz.Close()
+		data = gz
+	default:
+		return nil, fmt.Errorf("unsupported NRRD encoding: %q", fields["encoding"])
+	}
+
+	if v.Data, err = readVolumeData(data, v.NumVoxels()*datatype.Size()); err != nil {
+		return nil, fmt.Errorf("failed to read NRRD data: %w", err)
+	}
+	if fields["endian"] == "big" {
+		swapBytes(v.Data, datatype.Size())
+	}
+
+	return v, nil
+}
+
+// nrrdAffine builds a RAS affine from space directions and origin, falling
+// back to per-axis spacings
+func nrrdAffine(fields map[string]string, ndim int) ([4][4]float64, error) {
+	affine := identityAffine()
+
+	directions, ok := fields["space directions"]
+	if !ok {
+		if spacings, ok := fields["spacings"]; ok {
+			values := strings.Fields(spacings)
+			for axis := 0; axis < len(values) && axis < 3; axis++ {
+				if s, err := strconv.ParseFloat(values[axis], 64); err == nil {
+					affine[axis][axis] = s
+				}
+			}
+		}
+		return affine, nil
+	}
+
+	signs, ok := nrrdSpaceSigns[strings.ToLower(fields["space"])]
+	if !ok {
+		return affine, fmt.Errorf("unsupported NRRD space: %q", fields["space"])
+	}
+
+	vectors := strings.Fields(directions)
+	if len(vectors) != ndim {
+		return affine, fmt.Errorf("NRRD space directions do not match dimension")
+	}
+	for axis, vector := range vectors {
+		if vector == "none" {
+			return affine, fmt.Errorf("non-spatial NRRD axes are not supported")
+		}
+		values, err := parseVector(vector)
+		if err != nil || len(values) != 3 {
+			return affine, fmt.Errorf("invalid NRRD space direction: %q", vector)
+		}
+		for world := 0; world < 3; world++ {
+			affine[world][axis] = values[world] * signs[world]
+		}
+	}
+
+	if origin, ok := fields["space origin"]; ok {
+		values, err := parseVector(origin)
+		if err != nil || len(values) != 3 {
+			return affine, fmt.Errorf("invalid NRRD space origin: %q", origin)
+		}
+		for world := 0; world < 3; world++ {
+			affine[world][3] = values[world] * signs[world]
+		}
+	}
+
+	return affine, nil
+}
+
+// WriteNrrd writes a volume as a gzip encoded NRRD in LPS space
+func WriteNrrd(path string, v *Volume) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create NRRD file: %w", err)
+	}
+	defer file.Close()
+
+	signs := nrrdSpaceSigns["lps"]
+	directions := make([]string, len(v.Dims))
+	for axis := range v.Dims {
+		directions[axis] = formatVector(
+			v.Affine[0][axis]*signs[0],
+			v.Affine[1][axis]*signs[1],
+			v.Affine[2][axis]*signs[2],
+		)
+	}
+	kinds := strings.TrimSpace(strings.Repeat("domain ", len(v.Dims)))
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "NRRD0004\n")
+	fmt.Fprintf(w, "# Complete NRRD file format specification at:\n")
+	fmt.Fprintf(w, "# http://teem.sourceforge.net/nrrd/format.html\n")
+	fmt.Fprintf(w, "type: %s\n", nrrdTypeNames[v.Datatype])
+	fmt.Fprintf(w, "dimension: %d\n", len(v.Dims))
+	fmt.Fprintf(w, "space: left-posterior-superior\n")
+	fmt.Fprintf(w, "sizes: %s\n", formatInts(v.Dims))
+	fmt.Fprintf(w, "space directions: %s\n", strings.Join(directions, " "))
+	fmt.Fprintf(w, "kinds: %s\n", kinds)
+	fmt.Fprintf(w, "endian: little\n")
+	fmt.Fprintf(w, "encoding: gzip\n")
+	fmt.Fprintf(w, "space origin: %s\n\n", formatVector(
+		v.Affine[0][3]*signs[0],
+		v.Affine[1][3]*signs[1],
+		v.Affine[2][3]*signs[2],
+	))
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(v.Data); err != nil {
+		return fmt.Errorf("failed to write NRRD data: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write NRRD data: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write NRRD file: %w", err)
+	}
+
+	return nil
+}
+
+// parseVector parses a NRRD vector such as "(1,0,0)"
+func parseVector(s string) ([]float64, error) {
+	s = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(s), "("), ")")
+	parts := strings.Split(s, ",")
+	values := make([]float64, len(parts))
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func formatVector(values ...float64) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		if value == 0 {
+			value = 0 // avoid printing negative zero
+		}
+		parts[i] = strconv.FormatFloat(value, 'g', -1, 64)
+	}
+	return "(" + strings.Join(parts, ",") + ")"
+}
+
+func parseInts(s string) ([]int, error) {
+	fields := strings.Fields(s)
+	values := make([]int, len(fields))
+	for i, field := range fields {
+		value, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func formatInts(values []int) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = strconv.Itoa(value)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,119 @@
+package imaging
+
+import (
+	"bufio"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func decodeNrrdString(s string, headerOnly bool) (*Volume, error) {
+	return decodeNrrd(bufio.NewReader(strings.NewReader(s)), headerOnly)
+}
+
+func TestNrrdRoundTrip(t *testing.T) {
+	volume := &Volume{
+		Dims:     []int{3, 2, 2},
+		Datatype: Int16,
+		Affine:   [4][4]float64{{-0.5, 0, 0, 10}, {0, -0.5, 0, 20}, {0, 0, 2, -30}, {0, 0, 0, 1}},
+		Data:     encodeSamples([]float64{0, 1, 2, 3, 4, 5, -6, -7, 8, 9, 10, 11}, Int16),
+	}
+
+	path := filepath.Join(t.TempDir(), "volume.nrrd")
+	if err := WriteNrrd(path, volume); err != nil {
+		t.Fatalf("WriteNrrd: %v", err)
+	}
+	read, err := ReadNrrd(path)
+	if err != nil {
+		t.Fatalf("ReadNrrd: %v", err)
+	}
+
+	if !equalInts(read.Dims, volume.Dims) || read.Datatype != volume.Datatype {
+		t.Errorf("read %v %s, want %v %s", read.Dims, read.Datatype, volume.Dims, volume.Datatype)
+	}
+	if read.Affine != volume.Affine {
+		t.Errorf("affine = %v, want %v", read.Affine, volume.Affine)
+	}
+	if string(read.Data) != string(volume.Data) {
+		t.Errorf("data differs after round trip")
+	}
+}
+
+func TestNrrdHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{
+			name:   "not nrrd",
+			header: "P6\n",
+			want:   "not a NRRD file",
+		},
+		{
+			name:   "unterminated header",
+			header: "NRRD0004\ntype: uchar\n",
+			want:   "unexpected end of NRRD header",
+		},
+		{
+			name:   "malformed line",
+			header: "NRRD0004\ntype uchar\n\n",
+			want:   "malformed NRRD header line",
+		},
+		{
+			name:   "unknown type",
+			header: "NRRD0004\ntype: complex\ndimension: 1\nsizes: 4\nencoding: raw\n\n",
+			want:   "unsupported NRRD type",
+		},
+		{
+			name:   "dimension mismatch",
+			header: "NRRD0004\ntype: uchar\ndimension: 3\nsizes: 4 4\nencoding: raw\n\n",
+			want:   "does not match sizes",
+		},
+		{
+			name:   "too many dimensions",
+			header: "NRRD0004\ntype: uchar\ndimension: 5\nsizes: 2 2 2 2 2\nspace: left-posterior-superior\nspace directions: (1,0,0) (0,1,0) (0,0,1) (1,1,0) (0,1,1)\nencoding: raw\n\n",
+			want:   "unsupported number of dimensions: 5",
+		},
+		{
+			name:   "oversized axis",
+			header: "NRRD0004\ntype: uchar\ndimension: 3\nsizes: 70000 2 2\nencoding: raw\n\n",
+			want:   "invalid dimension size: 70000",
+		},
+		{
+			name:   "oversized volume",
+			header: "NRRD0004\ntype: double\ndimension: 3\nsizes: 65536 65536 2\nencoding: raw\n\n",
+			want:   "the limit is",
+		},
+		{
+			name:   "detached data",
+			header: "NRRD0004\ntype: uchar\ndimension: 1\nsizes: 4\ndata file: volume.raw\nencoding: raw\n\n",
+			want:   "detached NRRD data files are not supported",
+		},
+		{
+			name:   "invalid space direction",
+			header: "NRRD0004\ntype: uchar\ndimension: 2\nsizes: 2 2\nspace: lps\nspace directions: (1,0) (0,1)\nencoding: raw\n\n",
+			want:   "invalid NRRD space direction",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeNrrdString(tt.header, true)
+			if err == nil {
+				t.Fatalf("decodeNrrd succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNrrdTruncatedData(t *testing.T) {
+	header := "NRRD0004\ntype: uchar\ndimension: 3\nsizes: 4 4 4\nencoding: raw\n\n"
+	_, err := decodeNrrdString(header+strings.Repeat("x", 10), false)
+	if err == nil || !strings.Contains(err.Error(), "got 10 of 64 bytes") {
+		t.Errorf("error = %v, want a short read of 10 of 64 bytes", err)
+	}
+}
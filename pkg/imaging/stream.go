@@ -0,0 +1,309 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// sourceDtypePrefix marks the original image dtype recorded in the NIfTI
+// description by the converter script
+const sourceDtypePrefix = "source_dtype="
+
+// StreamValidator checks a NIfTI stream against the input geometry and a
+// model's output spec while the stream is copied elsewhere, e.g. through an
+// io.TeeReader into object storage. Only the header and the middle slice
+// are kept in memory; the slice is used to render a preview.
+type StreamValidator struct {
+	input *Volume
+	spec  *OutputSpec
+
+	header []byte
+	output *Volume
+	layout niftiLayout
+
+	offset     int64 // bytes consumed so far
+	dataStart  int64
+	dataEnd    int64
+	sliceStart int64
+	slice      []byte
+	partial    []byte
+	sample     []byte
+
+	labels     map[float64]bool
+	unexpected map[float64]bool
+	err        error
+}
+
+func NewStreamValidator(input *Volume, spec *OutputSpec) *StreamValidator {
+	if spec == nil {
+		spec = &OutputSpec{}
+	}
+
+	labels := map[float64]bool{}
+	for _, label := range spec.Labels {
+		labels[float64(label)] = true
+	}
+
+	return &StreamValidator{
+		input:      input,
+		spec:       spec,
+		labels:     labels,
+		unexpected: map[float64]bool{},
+	}
+}
+
+// Write consumes the next part of the stream. It returns an error as soon
+// as the stream is known to be invalid.
+func (v *StreamValidator) Write(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		if v.output == nil {
+			p = v.consumeHeader(p)
+			if v.err != nil {
+				return 0, v.err
+			}
+			continue
+		}
+
+		if v.offset < v.dataStart {
+			skip := min(int64(len(p)), v.dataStart-v.offset)
+			v.offset += skip
+			p = p[skip:]
+			continue
+		}
+
+		if v.offset >= v.dataEnd {
+			// Trailing bytes after the voxel data are ignored
+			v.offset += int64(len(p))
+			break
+		}
+
+		chunk := p[:min(int64(len(p)), v.dataEnd-v.offset)]
+		v.consumeData(chunk)
+		if v.err != nil {
+			return 0, v.err
+		}
+		v.offset += int64(len(chunk))
+		p = p[len(chunk):]
+	}
+
+	return n, nil
+}
+
+func (v *StreamValidator) consumeHeader(p []byte) []byte {
+	need := niftiHeaderSize - len(v.header)
+	take := min(need, len(p))
+	v.header = append(v.header, p[:take]...)
+	v.offset += int64(take)
+	if len(v.header) < niftiHeaderSize {
+		return p[take:]
+	}
+
+	output, layout, err := parseNiftiHeader(v.header)
+	if err != nil {
+		v.err = fmt.Errorf("%w: not a readable NIfTI file: %s", ErrInvalidOutput, err.Error())
+		return nil
+	}
+	if err := v.checkHeader(output); err != nil {
+		v.err = err
+		return nil
+	}
+
+	v.output = output
+	v.layout = layout
+	v.dataStart = layout.voxOffset
+	v.dataEnd = v.dataStart + int64(output.NumVoxels()*output.Datatype.Size())
+
+	dims := output.dims3()
+	sliceSize := int64(dims[0] * dims[1] * output.Datatype.Size())
+	v.sliceStart = v.dataStart + int64(dims[2]/2)*sliceSize
+	v.slice = make([]byte, 0, sliceSize)
+	v.sample = make([]byte, output.Datatype.Size())
+
+	return p[take:]
+}
+
+// checkHeader compares the output geometry and datatype with the input
+// and the declared spec
+func (v *StreamValidator) checkHeader(output *Volume) error {
+	expectedShape := v.input.dims3()
+	if len(v.spec.Shape) > 0 {
+		expectedShape = []int{1, 1, 1}
+		copy(expectedShape, v.spec.Shape)
+	}
+	if shape := output.dims3(); !equalInts(shape, expectedShape) {
+		return fmt.Errorf("%w: shape %v does not match expected %v", ErrInvalidOutput, shape, expectedShape)
+	}
+
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 4; col++ {
+			if math.Abs(output.Affine[row][col]-v.input.Affine[row][col]) > affineTolerance {
+				return fmt.Errorf("%w: affine does not match the input geometry", ErrInvalidOutput)
+			}
+		}
+	}
+
+	if len(v.spec.Datatypes) > 0 {
+		allowed := false
+		for _, datatype := range v.spec.Datatypes {
+			if datatype == output.Datatype.String() {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: datatype %s is not one of %v", ErrInvalidOutput, output.Datatype, v.spec.Datatypes)
+		}
+	}
+
+	return nil
+}
+
+func (v *StreamValidator) consumeData(chunk []byte) {
+	// Keep the middle slice for rendering
+	sliceEnd := v.sliceStart + int64(cap(v.slice))
+	if start, end := max(v.offset, v.sliceStart), min(v.offset+int64(len(chunk)), sliceEnd); start < end {
+		v.slice = append(v.slice, chunk[start-v.offset:end-v.offset]...)
+	}
+
+	size := len(v.sample)
+	data := chunk
+	if len(v.partial) > 0 {
+		take := min(size-len(v.partial), len(data))
+		v.partial = append(v.partial, data[:take]...)
+		data = data[take:]
+		if len(v.partial) < size {
+			return
+		}
+		v.checkSample(v.partial)
+		v.partial = v.partial[:0]
+	}
+
+	for len(data) >= size {
+		v.checkSample(data[:size])
+		if v.err != nil {
+			return
+		}
+		data = data[size:]
+	}
+	v.partial = append(v.partial, data...)
+}
+
+func (v *StreamValidator) checkSample(raw []byte) {
+	value := v.value(raw)
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		v.err = fmt.Errorf("%w: contains NaN or infinite values", ErrInvalidOutput)
+		return
+	}
+	if len(v.labels) > 0 && !v.labels[value] && len(v.unexpected) < 10 {
+		v.unexpected[value] = true
+	}
+}
+
+// value decodes one sample in the stream's byte order and applies scaling
+func (v *StreamValidator) value(raw []byte) float64 {
+	copy(v.sample, raw)
+	if v.layout.order == binary.BigEndian {
+		swapBytes(v.sample, len(v.sample))
+	}
+	value := decodeSample(v.sample, v.output.Datatype)
+	if v.layout.scaled() {
+		value = value*v.layout.slope + v.layout.inter
+	}
+	return value
+}
+
+// Err returns the error that stopped the stream, if any
+func (v *StreamValidator) Err() error {
+	return v.err
+}
+
+// Close finishes validation and reports whether the stream was valid
+func (v *StreamValidator) Close() error {
+	if v.err != nil {
+		return v.err
+	}
+	if v.output == nil {
+		return fmt.Errorf("%w: empty or truncated response", ErrInvalidOutput)
+	}
+	if v.offset < v.dataEnd {
+		return fmt.Errorf("%w: truncated voxel data", ErrInvalidOutput)
+	}
+
+	if len(v.unexpected) > 0 {
+		values := make([]float64, 0, len(v.unexpected))
+		for value := range v.unexpected {
+			values = append(values, value)
+		}
+		sort.Float64s(values)
+		return fmt.Errorf("%w: unexpected label values %v, allowed %v", ErrInvalidOutput, values, v.spec.Labels)
+	}
+
+	return nil
+}
+
+// RenderPNG writes the middle slice as a PNG in the same layout as the
+// converter script: rows along the first axis and columns along the second.
+// The original 8 or 16 bit depth is restored when recorded in the header,
+// otherwise values are normalized to 0-255.
+func (v *StreamValidator) RenderPNG(w io.Writer) error {
+	if err := v.Close(); err != nil {
+		return err
+	}
+
+	dims := v.output.dims3()
+	rows, cols := dims[0], dims[1]
+
+	values := make([]float64, rows*cols)
+	size := len(v.sample)
+	minValue, maxValue := math.Inf(1), math.Inf(-1)
+	for i := range values {
+		values[i] = v.value(v.slice[i*size : (i+1)*size])
+		minValue = math.Min(minValue, values[i])
+		maxValue = math.Max(maxValue, values[i])
+	}
+
+	sourceDtype := ""
+	if strings.HasPrefix(v.output.Description, sourceDtypePrefix) {
+		sourceDtype = strings.TrimPrefix(v.output.Description, sourceDtypePrefix)
+	}
+
+	bounds := image.Rect(0, 0, cols, rows)
+	var img image.Image
+	switch sourceDtype {
+	case "uint16":
+		gray := image.NewGray16(bounds)
+		for i, value := range values {
+			gray.SetGray16(i/rows, i%rows, color.Gray16{Y: uint16(math.Max(0, math.Min(65535, math.Round(value))))})
+		}
+		img = gray
+	case "uint8":
+		gray := image.NewGray(bounds)
+		for i, value := range values {
+			gray.SetGray(i/rows, i%rows, color.Gray{Y: uint8(math.Max(0, math.Min(255, math.Round(value))))})
+		}
+		img = gray
+	default:
+		gray := image.NewGray(bounds)
+		for i, value := range values {
+			scaled := 0.0
+			if maxValue > minValue {
+				scaled = (value - minValue) / (maxValue - minValue) * 255
+			}
+			gray.SetGray(i/rows, i%rows, color.Gray{Y: uint8(scaled)})
+		}
+		img = gray
+	}
+
+	return png.Encode(w, img)
+}
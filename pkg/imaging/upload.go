@@ -0,0 +1,55 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// UploadHeaderSize is how much of an upload is buffered to validate it and
+// read its header before the rest is streamed to storage
+const UploadHeaderSize = 64 << 10
+
+// InspectUpload validates an upload from its first bytes and reads the
+// metadata its header holds, without the file touching the disk. header is
+// the whole file when shorter than UploadHeaderSize. Width is left at zero
+// when the header alone does not describe the image (TIFF and WebP, or a
+// JPEG whose frame header is past the buffered bytes), the metadata is then
+// read with ExtractMetadata once the file is downloaded.
+func InspectUpload(header []byte, ext string) (*Metadata, error) {
+	ext = strings.ToLower(ext)
+
+	switch ext {
+	case ".nrrd", ".mha":
+		var volume *Volume
+		var err error
+		r := bufio.NewReader(bytes.NewReader(header))
+		if ext == ".nrrd" {
+			volume, err = decodeNrrd(r, true)
+		} else {
+			volume, err = decodeMetaImage(r, true)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return describeVolume(volume, ext), nil
+	}
+
+	contentType := DetectContentType(header[:min(len(header), 512)])
+	switch contentType {
+	case "image/jpeg", "image/png":
+		meta, err := decodeRasterMetadata(bytes.NewReader(header))
+		if err == nil {
+			return meta, nil
+		}
+		if len(header) < UploadHeaderSize {
+			return nil, err
+		}
+		return &Metadata{Format: strings.TrimPrefix(contentType, "image/")}, nil
+	case "image/tiff", "image/webp":
+		return &Metadata{Format: strings.TrimPrefix(contentType, "image/")}, nil
+	}
+
+	return nil, fmt.Errorf("invalid file type: %s, only JPEG, PNG, TIFF and WebP allowed", contentType)
+}
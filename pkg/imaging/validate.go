@@ -0,0 +1,63 @@
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrInvalidOutput is returned when a model output fails validation
+var ErrInvalidOutput = errors.New("invalid model output")
+
+// affineTolerance is the largest difference in mm allowed between input and
+// output affines, which covers float32 rounding in NIfTI headers
+const affineTolerance = 1e-3
+
+// OutputSpec is the output a model declares to produce. Empty fields are
+// not checked.
+type OutputSpec struct {
+	Datatypes []string `json:"datatypes"` // e.g. ["uint8", "int16"]
+	Labels    []int    `json:"labels"`    // allowed voxel values of a label map
+	Shape     []int    `json:"shape"`     // expected dimensions, defaults to the input's
+}
+
+// ValidateOutput checks a model output against the input geometry and the
+// declared spec. The output must be a readable NIfTI file with the input's
+// dimensions and affine, and contain no NaN or infinite values.
+func ValidateOutput(inputNiiPath string, outputNiiPath string, spec *OutputSpec) error {
+	input, err := ReadNiftiHeader(inputNiiPath)
+	if err != nil {
+		return fmt.Errorf("failed to read input volume: %w", err)
+	}
+
+	file, err := os.Open(outputNiiPath)
+	if err != nil {
+		return fmt.Errorf("%w: not a readable NIfTI file: %s", ErrInvalidOutput, err.Error())
+	}
+	defer file.Close()
+
+	r, err := decompressNifti(file)
+	if err != nil {
+		return fmt.Errorf("%w: not a readable NIfTI file: %s", ErrInvalidOutput, err.Error())
+	}
+	defer r.Close()
+
+	validator := NewStreamValidator(input, spec)
+	if _, err := io.Copy(validator, r); err != nil && !errors.Is(err, ErrInvalidOutput) {
+		return fmt.Errorf("failed to read output volume: %w", err)
+	}
+	return validator.Close()
+}
+
+func equalInts(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,277 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// Datatype is the sample type of a volume
+type Datatype int
+
+const (
+	Uint8 Datatype = iota + 1
+	Int8
+	Uint16
+	Int16
+	Uint32
+	Int32
+	Uint64
+	Int64
+	Float32
+	Float64
+)
+
+// Size returns the number of bytes per sample
+func (d Datatype) Size() int {
+	switch d {
+	case Uint8, Int8:
+		return 1
+	case Uint16, Int16:
+		return 2
+	case Uint32, Int32, Float32:
+		return 4
+	case Uint64, Int64, Float64:
+		return 8
+	}
+	return 0
+}
+
+func (d Datatype) String() string {
+	switch d {
+	case Uint8:
+		return "uint8"
+	case Int8:
+		return "int8"
+	case Uint16:
+		return "uint16"
+	case Int16:
+		return "int16"
+	case Uint32:
+		return "uint32"
+	case Int32:
+		return "int32"
+	case Uint64:
+		return "uint64"
+	case Int64:
+		return "int64"
+	case Float32:
+		return "float32"
+	case Float64:
+		return "float64"
+	}
+	return "unknown"
+}
+
+// Limits on the size of a volume, checked before any voxel data is read so
+// a crafted header cannot make a reader allocate more than a real scan needs
+const (
+	maxAxisSize   = 1 << 16
+	maxVolumeSize = 4 << 30
+)
+
+// Volume is a scalar image held in memory together with its geometry
+type Volume struct {
+	Dims        []int         // size along each axis, first axis varies fastest
+	Datatype    Datatype      // sample type of Data
+	Affine      [4][4]float64 // voxel index to RAS world coordinates in mm
+	Description string
+	Data        []byte // little-endian samples
+}
+
+// NumVoxels returns the number of samples in the volume
+func (v *Volume) NumVoxels() int {
+	n := 1
+	for _, d := range v.Dims {
+		n *= d
+	}
+	return n
+}
+
+// Spacing returns the voxel size along the first three axes in mm
+func (v *Volume) Spacing() []float64 {
+	spacing := make([]float64, 3)
+	for axis := 0; axis < 3; axis++ {
+		spacing[axis] = math.Sqrt(v.Affine[0][axis]*v.Affine[0][axis] +
+			v.Affine[1][axis]*v.Affine[1][axis] +
+			v.Affine[2][axis]*v.Affine[2][axis])
+	}
+	return spacing
+}
+
+// Orientation returns the world direction of each voxel axis as RAS
+// letters, e.g. "RAS" or "LPS"
+func (v *Volume) Orientation() string {
+	positive := []byte{'R', 'A', 'S'}
+	negative := []byte{'L', 'P', 'I'}
+
+	codes := make([]byte, 3)
+	for axis := 0; axis < 3; axis++ {
+		best := 0
+		for world := 1; world < 3; world++ {
+			if math.Abs(v.Affine[world][axis]) > math.Abs(v.Affine[best][axis]) {
+				best = world
+			}
+		}
+		if v.Affine[best][axis] < 0 {
+			codes[axis] = negative[best]
+		} else {
+			codes[axis] = positive[best]
+		}
+	}
+	return string(codes)
+}
+
+// Value returns sample i converted to float64
+func (v *Volume) Value(i int) float64 {
+	size := v.Datatype.Size()
+	return decodeSample(v.Data[i*size:(i+1)*size], v.Datatype)
+}
+
+// decodeSample converts one little-endian sample to float64
+func decodeSample(b []byte, datatype Datatype) float64 {
+	switch datatype {
+	case Uint8:
+		return float64(b[0])
+	case Int8:
+		return float64(int8(b[0]))
+	case Uint16:
+		return float64(binary.LittleEndian.Uint16(b))
+	case Int16:
+		return float64(int16(binary.LittleEndian.Uint16(b)))
+	case Uint32:
+		return float64(binary.LittleEndian.Uint32(b))
+	case Int32:
+		return float64(int32(binary.LittleEndian.Uint32(b)))
+	case Uint64:
+		return float64(binary.LittleEndian.Uint64(b))
+	case Int64:
+		return float64(int64(binary.LittleEndian.Uint64(b)))
+	case Float32:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	case Float64:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	return 0
+}
+
+// validate checks that the data length matches dims and datatype
+func (v *Volume) validate() error {
+	if len(v.Dims) == 0 || len(v.Dims) > 3 {
+		return fmt.Errorf("unsupported number of dimensions: %d", len(v.Dims))
+	}
+	for _, d := range v.Dims {
+		if d < 1 || d > maxAxisSize {
+			return fmt.Errorf("invalid dimension size: %d", d)
+		}
+	}
+	if v.Datatype.Size() == 0 {
+		return fmt.Errorf("unsupported datatype")
+	}
+	// Axes are capped, so the product cannot overflow
+	if size := v.NumVoxels() * v.Datatype.Size(); size > maxVolumeSize {
+		return fmt.Errorf("volume of %v %s holds %d bytes, the limit is %d", v.Dims, v.Datatype, size, maxVolumeSize)
+	}
+	if v.Data != nil && len(v.Data) != v.NumVoxels()*v.Datatype.Size() {
+		return fmt.Errorf("data size %d does not match dimensions %v of %s", len(v.Data), v.Dims, v.Datatype)
+	}
+	return nil
+}
+
+// readVolumeData reads the size bytes of voxel data. The buffer doubles
+// with the data actually read rather than being allocated up front, so a
+// header claiming more data than the file holds fails without the
+// allocation.
+func readVolumeData(r io.Reader, size int) ([]byte, error) {
+	data := make([]byte, min(size, 1<<20))
+	read := 0
+	for {
+		n, err := io.ReadFull(r, data[read:])
+		read += n
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("got %d of %d bytes: %w", read, size, err)
+		}
+		if read == size {
+			return data, nil
+		}
+
+		grown := make([]byte, min(size, 2*len(data)))
+		copy(grown, data)
+		data = grown
+	}
+}
+
+// dims3 returns the dimensions padded with ones to three axes
+func (v *Volume) dims3() []int {
+	dims := []int{1, 1, 1}
+	copy(dims, v.Dims)
+	return dims
+}
+
+func identityAffine() [4][4]float64 {
+	return [4][4]float64{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}, {0, 0, 0, 1}}
+}
+
+// swapBytes converts samples of the given size between byte orders in place
+func swapBytes(data []byte, size int) {
+	if size < 2 {
+		return
+	}
+	for i := 0; i+size <= len(data); i += size {
+		for a, b := i, i+size-1; a < b; a, b = a+1, b-1 {
+			data[a], data[b] = data[b], data[a]
+		}
+	}
+}
+
+// isVolumeFile reports whether the path has a NRRD or MetaImage extension
+func isVolumeFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".nrrd", ".mha":
+		return true
+	}
+	return false
+}
+
+// ReadVolume reads a NIfTI, NRRD or MetaImage file based on its extension
+func ReadVolume(path string) (*Volume, error) {
+	return readVolume(path, false)
+}
+
+// readVolumeHeader reads only the geometry and datatype of a volume file
+func readVolumeHeader(path string) (*Volume, error) {
+	return readVolume(path, true)
+}
+
+func readVolume(path string, headerOnly bool) (*Volume, error) {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".nii"), strings.HasSuffix(lower, ".nii.gz"):
+		return readNifti(path, headerOnly)
+	case strings.HasSuffix(lower, ".nrrd"):
+		return readNrrd(path, headerOnly)
+	case strings.HasSuffix(lower, ".mha"):
+		return readMetaImage(path, headerOnly)
+	}
+	return nil, fmt.Errorf("unsupported volume format: %s", filepath.Ext(path))
+}
+
+// WriteVolume writes a NIfTI, NRRD or MetaImage file based on its extension
+func WriteVolume(path string, v *Volume) error {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".nii"), strings.HasSuffix(lower, ".nii.gz"):
+		return WriteNifti(path, v)
+	case strings.HasSuffix(lower, ".nrrd"):
+		return WriteNrrd(path, v)
+	case strings.HasSuffix(lower, ".mha"):
+		return WriteMetaImage(path, v)
+	}
+	return fmt.Errorf("unsupported volume format: %s", filepath.Ext(path))
+}
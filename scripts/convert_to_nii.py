@@ -2,60 +2,105 @@
 # scripts/convert_to_nii.py
 
 import sys
+import json
 import numpy as np
 import nibabel as nib
 from PIL import Image
 import argparse
 
+SOURCE_DTYPE_PREFIX = "source_dtype="
+
+def load_grayscale(img):
+    """
+    Load a PIL image as a grayscale array, keeping its native bit depth.
+
+    Returns:
+        (array, dtype name) where dtype is the original sample type
+    """
+    if img.mode in ('I;16', 'I;16L', 'I;16B'):
+        return np.array(img).astype(np.uint16), 'uint16'
+
+    if img.mode == 'I':
+        # Pillow opens 16-bit grayscale PNGs as 32-bit integers
+        img_array = np.array(img)
+        if img_array.min() >= 0 and img_array.max() <= np.iinfo(np.uint16).max:
+            return img_array.astype(np.uint16), 'uint16'
+        return img_array.astype(np.int32), 'int32'
+
+    if img.mode == 'F':
+        return np.array(img).astype(np.float32), 'float32'
+
+    if img.mode in ('L', 'LA', '1'):
+        return np.array(img.convert('L')).astype(np.uint8), 'uint8'
+
+    # Color images: convert to grayscale using standard formula
+    img_array = np.array(img.convert('RGB'))
+    grayscale = np.dot(img_array[..., :3], [0.299, 0.587, 0.114])
+    return np.rint(grayscale).clip(0, 255).astype(np.uint8), 'uint8'
+
 def image_to_nii(input_path, output_path):
     """
-    Convert PNG/JPEG image to NII format.
+    Convert PNG/JPEG/TIFF/WebP image to NII format.
+
+    Grayscale and 16-bit images keep their native sample values; the
+    original dtype is recorded in the header description so the reverse
+    conversion can restore it.
     
     Args:
-        input_path: Path to input image (PNG/JPEG)
+        input_path: Path to input image (PNG/JPEG/TIFF/WebP)
         output_path: Path to output NII file
     """
     try:
         # Load image
         img = Image.open(input_path)
         
-        # Convert to RGB if needed
-        if img.mode != 'RGB':
-            img = img.convert('RGB')
-        
-        # Convert to numpy array
-        img_array = np.array(img)
+        # Multi-page TIFFs are stacked into a 3D volume, one slice per page
+        slices = []
+        dtypes = []
+        for page in range(getattr(img, 'n_frames', 1) if img.format == 'TIFF' else 1):
+            img.seek(page)
+            
+            # Convert to numpy array without losing bit depth
+            img_array, page_dtype = load_grayscale(img)
+            if slices and img_array.shape != slices[0].shape:
+                raise ValueError(f"page {page} has shape {img_array.shape}, expected {slices[0].shape}")
+            slices.append(img_array)
+            dtypes.append(page_dtype)
         
-        # For medical imaging, we typically need grayscale
-        # Convert RGB to grayscale using standard formula
-        if len(img_array.shape) == 3:
-            grayscale = np.dot(img_array[...,:3], [0.299, 0.587, 0.114])
-            img_array = grayscale.astype(np.float32)
+        source_dtype = np.result_type(*dtypes).name
         
-        # Add a third dimension to make it 3D (required for NII)
-        # This creates a single slice volume
-        img_3d = np.expand_dims(img_array, axis=2)
-        
-        # Normalize to 0-1 range
-        img_3d = img_3d / 255.0
+        # Stack slices along the third dimension (required for NII)
+        # A single image becomes a one slice volume
+        img_3d = np.stack(slices, axis=2).astype(source_dtype)
         
         # Create affine transformation matrix (identity with 1mm spacing)
         affine = np.eye(4)
         
         # Create NIfTI image
         nii_img = nib.Nifti1Image(img_3d, affine)
+        nii_img.header.set_data_dtype(img_3d.dtype)
+        nii_img.header['descrip'] = f"{SOURCE_DTYPE_PREFIX}{source_dtype}".encode()
         
         # Save NII file
         nib.save(nii_img, output_path)
         
         print(f"Successfully converted {input_path} to {output_path}")
-        print(f"Output shape: {img_3d.shape}")
+        print(f"Output shape: {img_3d.shape}, dtype: {source_dtype}")
         return 0
         
     except Exception as e:
         print(f"Error converting image: {str(e)}", file=sys.stderr)
         return 1
 
+def source_dtype(nii_img):
+    """
+    Return the original image dtype recorded by image_to_nii, or None.
+    """
+    descrip = nii_img.header['descrip'].tobytes().split(b'\x00', 1)[0].decode(errors='ignore')
+    if descrip.startswith(SOURCE_DTYPE_PREFIX):
+        return descrip[len(SOURCE_DTYPE_PREFIX):]
+    return None
+
 def nii_to_image(input_path, output_path):
     """
     Convert NII file back to PNG image.
@@ -79,8 +124,19 @@ def nii_to_image(input_path, output_path):
         else:
             img_2d = img_data
         
-        # Normalize to 0-255 range
-        img_2d = ((img_2d - img_2d.min()) / (img_2d.max() - img_2d.min()) * 255).astype(np.uint8)
+        # Restore the original sample type when it was recorded, otherwise
+        # normalize to 0-255 range
+        dtype = source_dtype(nii_img)
+        if dtype in ('uint8', 'uint16'):
+            info = np.iinfo(dtype)
+            img_2d = np.rint(img_2d).clip(info.min, info.max).astype(dtype)
+        else:
+            value_range = img_2d.max() - img_2d.min()
+            if value_range > 0:
+                img_2d = (img_2d - img_2d.min()) / value_range * 255
+            else:
+                img_2d = np.zeros_like(img_2d)
+            img_2d = img_2d.astype(np.uint8)
         
         # Create PIL image and save
         pil_img = Image.fromarray(img_2d)
@@ -93,15 +149,168 @@ def nii_to_image(input_path, output_path):
         print(f"Error converting NII: {str(e)}", file=sys.stderr)
         return 1
 
+def compare_nii(input_a, input_b, output_path):
+    """
+    Compare two NII label volumes and render a difference map.
+
+    Prints a JSON report with per-label volumes to stdout.
+
+    Args:
+        input_a: Path to the baseline NII file
+        input_b: Path to the follow-up NII file
+        output_path: Path to output difference map (PNG)
+    """
+    try:
+        nii_a = nib.load(input_a)
+        nii_b = nib.load(input_b)
+
+        # Volumes must share the voxel grid to be compared voxel by voxel
+        if nii_a.shape != nii_b.shape:
+            print(json.dumps({
+                "compatible": False,
+                "reason": f"shape mismatch: {list(nii_a.shape)} vs {list(nii_b.shape)}",
+            }))
+            return 0
+
+        zooms_a = np.array(nii_a.header.get_zooms()[:3], dtype=np.float64)
+        zooms_b = np.array(nii_b.header.get_zooms()[:3], dtype=np.float64)
+        if not np.allclose(zooms_a, zooms_b, atol=1e-3):
+            print(json.dumps({
+                "compatible": False,
+                "reason": f"spacing mismatch: {zooms_a.tolist()} vs {zooms_b.tolist()}",
+            }))
+            return 0
+
+        if not np.allclose(nii_a.affine, nii_b.affine, atol=1e-3):
+            print(json.dumps({
+                "compatible": False,
+                "reason": "affine mismatch: volumes are not in the same space",
+            }))
+            return 0
+
+        data_a = np.rint(nii_a.get_fdata()).astype(np.int64)
+        data_b = np.rint(nii_b.get_fdata()).astype(np.int64)
+        voxel_volume = float(np.prod(zooms_a))
+
+        labels = []
+        for label in np.union1d(np.unique(data_a), np.unique(data_b)):
+            if label == 0:
+                continue
+            volume_a = float(np.count_nonzero(data_a == label)) * voxel_volume
+            volume_b = float(np.count_nonzero(data_b == label)) * voxel_volume
+            delta_percent = None
+            if volume_a > 0:
+                delta_percent = (volume_b - volume_a) / volume_a * 100.0
+            labels.append({
+                "label": int(label),
+                "volume_a_mm3": volume_a,
+                "volume_b_mm3": volume_b,
+                "delta_mm3": volume_b - volume_a,
+                "delta_percent": delta_percent,
+            })
+
+        # Signed difference of the middle slice, 128 means unchanged
+        diff = nii_b.get_fdata() - nii_a.get_fdata()
+        if len(diff.shape) == 3:
+            diff = diff[:, :, diff.shape[2] // 2]
+        scale = np.abs(diff).max()
+        if scale > 0:
+            diff = diff / scale
+        diff_img = ((diff + 1.0) * 127.5).clip(0, 255).astype(np.uint8)
+        Image.fromarray(diff_img).save(output_path)
+
+        print(json.dumps({
+            "compatible": True,
+            "shape": [int(d) for d in nii_a.shape],
+            "spacing": zooms_a.tolist(),
+            "voxel_volume_mm3": voxel_volume,
+            "labels": labels,
+        }))
+        return 0
+
+    except Exception as e:
+        print(f"Error comparing NII: {str(e)}", file=sys.stderr)
+        return 1
+
+def image_info(input_path):
+    """
+    Print metadata of a NIfTI, DICOM, TIFF or WebP file as JSON to stdout.
+
+    Args:
+        input_path: Path to input file (NII, DCM, TIFF or WebP)
+    """
+    try:
+        if input_path.endswith(('.nii', '.nii.gz')):
+            nii_img = nib.load(input_path)
+            shape = [int(d) for d in nii_img.shape]
+            info = {
+                "format": "nifti",
+                "width": shape[0],
+                "height": shape[1] if len(shape) > 1 else 1,
+                "depth": shape[2] if len(shape) > 2 else 1,
+                "bit_depth": int(nii_img.get_data_dtype().itemsize * 8),
+                "color_mode": str(nii_img.get_data_dtype()),
+                "spacing": [float(z) for z in nii_img.header.get_zooms()[:3]],
+                "orientation": "".join(nib.aff2axcodes(nii_img.affine)),
+                "modality": "",
+            }
+        elif input_path.lower().endswith(('.tif', '.tiff', '.webp')):
+            img = Image.open(input_path)
+            _, dtype = load_grayscale(img)
+            info = {
+                "format": img.format.lower(),
+                "width": img.width,
+                "height": img.height,
+                "depth": getattr(img, 'n_frames', 1) if img.format == 'TIFF' else 1,
+                "bit_depth": int(np.dtype(dtype).itemsize * 8),
+                "color_mode": img.mode,
+                "spacing": [],
+                "orientation": "",
+                "modality": "",
+            }
+        else:
+            import pydicom
+            ds = pydicom.dcmread(input_path)
+            spacing = [float(v) for v in ds.get("PixelSpacing", [])]
+            if "SliceThickness" in ds:
+                spacing.append(float(ds.SliceThickness))
+            orientation = ds.get("ImageOrientationPatient", [])
+            info = {
+                "format": "dicom",
+                "width": int(ds.Columns),
+                "height": int(ds.Rows),
+                "depth": int(ds.get("NumberOfFrames", 1)),
+                "bit_depth": int(ds.BitsStored),
+                "color_mode": str(ds.PhotometricInterpretation),
+                "spacing": spacing,
+                "orientation": ",".join(f"{float(v):g}" for v in orientation),
+                "modality": str(ds.get("Modality", "")),
+            }
+
+        print(json.dumps(info))
+        return 0
+
+    except Exception as e:
+        print(f"Error reading metadata: {str(e)}", file=sys.stderr)
+        return 1
+
 if __name__ == "__main__":
     parser = argparse.ArgumentParser(description='Convert between image and NII formats')
     parser.add_argument('input', help='Input file path')
-    parser.add_argument('output', help='Output file path')
+    parser.add_argument('output', nargs='?', help='Output file path')
     parser.add_argument('--reverse', action='store_true', help='Convert NII to image instead')
+    parser.add_argument('--compare', metavar='OTHER', help='Compare input NII against OTHER and render a difference map')
+    parser.add_argument('--info', action='store_true', help='Print NII/DICOM/TIFF/WebP metadata as JSON')
     
     args = parser.parse_args()
     
-    if args.reverse:
+    if args.info:
+        sys.exit(image_info(args.input))
+    elif args.output is None:
+        parser.error('output is required')
+    elif args.compare:
+        sys.exit(compare_nii(args.input, args.compare, args.output))
+    elif args.reverse:
         sys.exit(nii_to_image(args.input, args.output))
     else:
         sys.exit(image_to_nii(args.input, args.output))
\ No newline at end of file